@@ -0,0 +1,415 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"staply_img_resizer/resizer"
+	"staply_img_resizer/storage"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//reprocessParams параметры команды reprocess
+type reprocessParams struct {
+	//presets пресеты, по которым пересоздаются миниатюры
+	presets []string
+	//tenant владелец миниатюр. Если раскладка содержит {tenant}, владелец берётся из пути исходника,
+	//а tenant оставляет только исходники этого владельца
+	tenant string
+	layout *storage.Layout
+	//prefix обрабатываются только исходники с этим префиксом пути
+	prefix string
+	//stateFile файл с путём последнего обработанного исходника для продолжения после остановки
+	stateFile string
+	//failedFile файл, в который дописываются пути исходников, обработанных с ошибкой
+	failedFile string
+	//retryFailed повторно обрабатываются только исходники из failedFile
+	retryFailed bool
+	//rate максимальное количество исходников в секунду, 0 - без ограничения
+	rate float64
+	//concurrency количество одновременно обрабатываемых исходников
+	concurrency int
+	//pageSize количество исходников, после обработки которых сохраняется состояние
+	pageSize int
+}
+
+//ReprocessReport итог команды reprocess
+type ReprocessReport struct {
+	Processed int
+	Failed    int
+	//Last путь последнего обработанного исходника
+	Last string
+}
+
+//Reprocess пересоздаёт миниатюры из сохранённых исходников по текущим пресетам.
+//Возвращает код завершения процесса
+func Reprocess(args []string) int {
+	var params reprocessParams
+	var presets string
+	fs := flag.NewFlagSet("reprocess", flag.ContinueOnError)
+	fs.StringVar(&presets, "presets", "", "comma separated presets to regenerate (required)")
+	fs.StringVar(&params.tenant, "tenant", "", "tenant of the regenerated thumbnails; with {tenant} in the layout, process only this tenant")
+	fs.StringVar(&params.prefix, "prefix", "", "process only originals with this path prefix")
+	fs.StringVar(&params.stateFile, "state", "reprocess.state", "file to save progress to and resume from, empty to disable")
+	fs.StringVar(&params.failedFile, "failed", "reprocess.failed", "file to record failed originals to, empty to disable")
+	fs.BoolVar(&params.retryFailed, "retry-failed", false, "reprocess only the originals recorded in the -failed file")
+	fs.Float64Var(&params.rate, "rate", 0, "max originals per second, 0 for no limit")
+	fs.IntVar(&params.concurrency, "concurrency", 4, "originals processed at once")
+	fs.IntVar(&params.pageSize, "page", 100, "originals between progress saves")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	for _, p := range strings.Split(presets, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			params.presets = append(params.presets, p)
+		}
+	}
+	if len(params.presets) == 0 || params.concurrency < 1 || params.pageSize < 1 || params.rate < 0 ||
+		(params.retryFailed && params.failedFile == "") {
+		fs.Usage()
+		return 2
+	}
+
+	//рядом может работать сервис: его временные файлы и сборщик хранилища не трогаем
+	store, err := storage.NewShared()
+	if err != nil {
+		log.Printf("Can't create storage: %v", err)
+		return 1
+	}
+	if params.layout, err = storage.LayoutFromConfig(); err != nil {
+		log.Printf("Bad storage layout config: %v", err)
+		return 1
+	}
+	r := resizer.NewImgResizerWithoutSweeper(store)
+	defer r.Stop()
+
+	//по сигналу остановки обработка прерывается, а прогресс сохраняется
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	//перегенерация не должна мешать интерактивным запросам
+	ctx = resizer.WithPriority(ctx, resizer.PriorityBulk)
+
+	var report ReprocessReport
+	if params.retryFailed {
+		report, err = retryFailed(ctx, r, store, params)
+	} else {
+		report, err = reprocess(ctx, r, store, params)
+	}
+	log.Printf("Reprocess finished: processed %d, failed %d, last '%s'", report.Processed, report.Failed, report.Last)
+	if err != nil {
+		log.Printf("Reprocess error: %v", err)
+		return 1
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+//reprocessor пересоздаёт миниатюры исходника, например *resizer.ImgResizer
+type reprocessor interface {
+	Reprocess(ctx context.Context, img []byte, baseID string, variants []resizer.Options) ([]*resizer.Result, error)
+}
+
+//reprocess проходит по исходникам в хранилище страницами по params.pageSize и отправляет их в resizer.
+//После каждой страницы пути исходников с ошибкой дописываются в params.failedFile, а путь её последнего
+//исходника сохраняется в params.stateFile, и следующий запуск продолжает с него.
+//При отмене ctx состояние сохраняется перед первым незавершённым исходником
+func reprocess(ctx context.Context, r reprocessor, store storage.Storage, params reprocessParams) (ReprocessReport, error) {
+	var report ReprocessReport
+	after, err := readState(params.stateFile)
+	if err != nil {
+		return report, err
+	}
+	if after != "" {
+		log.Printf("Resuming reprocess after '%s'", after)
+	}
+
+	throttle, stop := newThrottle(params.rate)
+	defer stop()
+
+	for {
+		originals, last, err := listOriginals(ctx, store, params, after)
+		if err != nil {
+			return report, err
+		}
+		if last == "" {
+			return report, nil
+		}
+
+		done, failed := processOriginals(ctx, r, store, originals, params, throttle, &report)
+		if err := appendFailed(params.failedFile, failed); err != nil {
+			return report, err
+		}
+
+		after = pageState(after, originals, done, last)
+		report.Last = after
+		if err := writeState(params.stateFile, after); err != nil {
+			return report, err
+		}
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		log.Printf("Reprocess progress: processed %d, failed %d, last '%s'", report.Processed, report.Failed, last)
+	}
+}
+
+//retryFailed повторно обрабатывает исходники из params.failedFile и оставляет в нём
+//только те, что снова завершились ошибкой или не были обработаны из-за отмены ctx
+func retryFailed(ctx context.Context, r reprocessor, store storage.Storage, params reprocessParams) (ReprocessReport, error) {
+	var report ReprocessReport
+	names, err := readFailed(params.failedFile)
+	if err != nil || len(names) == 0 {
+		return report, err
+	}
+	log.Printf("Retrying %d failed originals", len(names))
+
+	throttle, stop := newThrottle(params.rate)
+	defer stop()
+
+	done, failed := processOriginals(ctx, r, store, names, params, throttle, &report)
+	for i, ok := range done {
+		if !ok {
+			failed = append(failed, names[i])
+		}
+	}
+	if err := writeFailed(params.failedFile, failed); err != nil {
+		return report, err
+	}
+	return report, ctx.Err()
+}
+
+//newThrottle канал, ограничивающий обработку rate исходниками в секунду, nil - без ограничения
+func newThrottle(rate float64) (<-chan time.Time, func()) {
+	if rate <= 0 {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	return ticker.C, ticker.Stop
+}
+
+//processOriginals обрабатывает исходники names по params.concurrency одновременно и учитывает их в report.
+//Возвращает отметки завершённых исходников и пути исходников с ошибкой.
+//После отмены ctx новые исходники не запускаются, а прерванные не считаются ни завершёнными, ни ошибочными
+func processOriginals(ctx context.Context, r reprocessor, store storage.Storage, names []string, params reprocessParams,
+	throttle <-chan time.Time, report *ReprocessReport) ([]bool, []string) {
+	var done = make([]bool, len(names))
+	var failed []string
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var sem = make(chan struct{}, params.concurrency)
+	for i, name := range names {
+		if throttle != nil {
+			select {
+			case <-throttle:
+			case <-ctx.Done():
+			}
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := reprocessOriginal(ctx, r, store, name, params)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && ctx.Err() != nil {
+				return
+			}
+			done[i] = true
+			if err != nil {
+				log.Printf("Can't reprocess '%s': %v", name, err)
+				failed = append(failed, name)
+				report.Failed++
+				return
+			}
+			report.Processed++
+		}(i, name)
+	}
+	wg.Wait()
+	sort.Strings(failed)
+	return done, failed
+}
+
+//pageState путь, до которого обработана страница: перед первым незавершённым исходником или last
+func pageState(after string, originals []string, done []bool, last string) string {
+	for i, ok := range done {
+		if ok {
+			continue
+		}
+		if i == 0 {
+			return after
+		}
+		return originals[i-1]
+	}
+	return last
+}
+
+//listOriginals возвращает исходники из следующих params.pageSize файлов после after
+//и путь последнего просмотренного файла
+func listOriginals(ctx context.Context, store storage.Storage, params reprocessParams, after string) ([]string, string, error) {
+	files, err := store.List(ctx, params.prefix, after, params.pageSize)
+	if err != nil || len(files) == 0 {
+		return nil, "", err
+	}
+
+	var originals []string
+	for _, file := range files {
+		if _, ok := resizer.OriginalBaseID(file.Name); !ok {
+			continue
+		}
+		if _, ok := originalTenant(params, file.Name); ok {
+			originals = append(originals, file.Name)
+		}
+	}
+	return originals, files[len(files)-1].Name, nil
+}
+
+//originalTenant владелец миниатюр исходника name: из его пути, если раскладка содержит {tenant},
+//иначе params.tenant. false - исходник не относится к params.tenant
+func originalTenant(params reprocessParams, name string) (string, bool) {
+	if params.layout == nil || !params.layout.Uses("tenant") {
+		return params.tenant, true
+	}
+	fields, ok := params.layout.Parse(name)
+	if !ok {
+		return "", false
+	}
+	return fields.Tenant, params.tenant == "" || fields.Tenant == params.tenant
+}
+
+func reprocessOriginal(ctx context.Context, r reprocessor, store storage.Storage, name string, params reprocessParams) error {
+	baseID, _ := resizer.OriginalBaseID(name)
+	tenant, ok := originalTenant(params, name)
+	if !ok {
+		return fmt.Errorf("path doesn't match the storage layout")
+	}
+	file, _, err := store.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	img, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	var variants []resizer.Options
+	for _, preset := range params.presets {
+		variants = append(variants, resizer.Options{Preset: preset, Tenant: tenant})
+	}
+	_, err = r.Reprocess(ctx, img, baseID, variants)
+	return err
+}
+
+func readState(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("can't read state file; error %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+//readFailed читает пути из файла исходников с ошибкой без повторов
+func readFailed(name string) ([]string, error) {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read failed file; error %v", err)
+	}
+
+	var names []string
+	var seen = make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !seen[line] {
+			seen[line] = true
+			names = append(names, line)
+		}
+	}
+	return names, nil
+}
+
+//appendFailed дописывает пути исходников с ошибкой в файл name
+func appendFailed(name string, failed []string) error {
+	if name == "" || len(failed) == 0 {
+		return nil
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("can't write failed file; error %v", err)
+	}
+	_, err = file.WriteString(strings.Join(failed, "\n") + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("can't write failed file; error %v", err)
+	}
+	return nil
+}
+
+//writeFailed перезаписывает файл исходников с ошибкой, без ошибок файл удаляется
+func writeFailed(name string, failed []string) error {
+	if len(failed) == 0 {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("can't write failed file; error %v", err)
+		}
+		return nil
+	}
+	if err := writeAtomic(name, strings.Join(failed, "\n")+"\n"); err != nil {
+		return fmt.Errorf("can't write failed file; error %v", err)
+	}
+	return nil
+}
+
+func writeState(name string, after string) error {
+	if name == "" {
+		return nil
+	}
+	if err := writeAtomic(name, after+"\n"); err != nil {
+		return fmt.Errorf("can't write state file; error %v", err)
+	}
+	return nil
+}
+
+//writeAtomic атомарно записывает файл, чтобы остановка посреди записи не сбросила прогресс
+func writeAtomic(name string, data string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,187 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"staply_img_resizer/resizer"
+	"staply_img_resizer/storage"
+	"sync"
+	"testing"
+	"time"
+)
+
+type reprocessorMock struct {
+	mu       sync.Mutex
+	BaseIDs  []string
+	Variants []resizer.Options
+	//Tenants владельцы миниатюр по base_id
+	Tenants map[string]string
+	//Fail base_id, на котором возвращается ошибка
+	Fail string
+	//Cancel base_id, на котором обработка прерывается вызовом cancel
+	Cancel string
+	cancel context.CancelFunc
+}
+
+func (m *reprocessorMock) Reprocess(ctx context.Context, img []byte, baseID string, variants []resizer.Options) ([]*resizer.Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if baseID == m.Fail {
+		return nil, fmt.Errorf("reprocess error")
+	}
+	if baseID == m.Cancel {
+		m.cancel()
+		return nil, ctx.Err()
+	}
+	m.BaseIDs = append(m.BaseIDs, baseID)
+	m.Variants = variants
+	if m.Tenants == nil {
+		m.Tenants = make(map[string]string)
+	}
+	m.Tenants[baseID] = variants[0].Tenant
+	return nil, nil
+}
+
+func TestReprocess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reprocess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	store := storage.NewMemory()
+	for _, name := range []string{"a.jpeg", "a_original.jpeg", "b_avatar.png", "b_original.png",
+		"c_original.jpeg", "x/d_original.jpeg", "x/d_card.jpeg"} {
+		store.Put(ctx, name, []byte(name))
+	}
+
+	var params = reprocessParams{
+		presets:     []string{"avatar", "card"},
+		tenant:      "acme",
+		stateFile:   filepath.Join(dir, "state"),
+		failedFile:  filepath.Join(dir, "failed"),
+		concurrency: 2,
+		pageSize:    3,
+	}
+
+	//первый запуск падает на c, но сохраняет прогресс по страницам
+	mock := &reprocessorMock{Fail: "c"}
+	report, err := reprocess(ctx, mock, store, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(mock.BaseIDs)
+	if expected := []string{"a", "b", "d"}; !reflect.DeepEqual(mock.BaseIDs, expected) {
+		t.Errorf("Bad reprocessed originals. Expected '%v', got '%v'", expected, mock.BaseIDs)
+	}
+	if report.Processed != 3 || report.Failed != 1 || report.Last != "x/d_original.jpeg" {
+		t.Errorf("Bad report. Got '%+v'", report)
+	}
+	expectedVariants := []resizer.Options{{Preset: "avatar", Tenant: "acme"}, {Preset: "card", Tenant: "acme"}}
+	if !reflect.DeepEqual(mock.Variants, expectedVariants) {
+		t.Errorf("Bad variants. Expected '%+v', got '%+v'", expectedVariants, mock.Variants)
+	}
+	if failed, _ := readFailed(params.failedFile); !reflect.DeepEqual(failed, []string{"c_original.jpeg"}) {
+		t.Errorf("Bad failed originals. Expected '%v', got '%v'", []string{"c_original.jpeg"}, failed)
+	}
+
+	//повтор исходников с ошибкой не трогает состояние и очищает список
+	params.retryFailed = true
+	mock = &reprocessorMock{}
+	if report, err = retryFailed(ctx, mock, store, params); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"c"}; !reflect.DeepEqual(mock.BaseIDs, expected) || report.Processed != 1 {
+		t.Errorf("Bad retried originals. Expected '%v', got '%v'", expected, mock.BaseIDs)
+	}
+	if _, err := os.Stat(params.failedFile); !os.IsNotExist(err) {
+		t.Errorf("Failed file must be removed after successful retry, got '%v'", err)
+	}
+	params.retryFailed = false
+
+	//новый исходник после сохранённого состояния обрабатывается, старые - нет
+	store.Put(ctx, "y_original.jpeg", []byte("y"))
+	mock = &reprocessorMock{}
+	if report, err = reprocess(ctx, mock, store, params); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"y"}; !reflect.DeepEqual(mock.BaseIDs, expected) || report.Processed != 1 {
+		t.Errorf("Bad resumed originals. Expected '%v', got '%v'", expected, mock.BaseIDs)
+	}
+
+	//при отмене состояние сохраняется перед прерванным исходником, и он обрабатывается следующим запуском
+	os.Remove(params.stateFile)
+	params.concurrency = 1
+	cancelCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	mock = &reprocessorMock{Cancel: "b", cancel: cancel}
+	report, err = reprocess(cancelCtx, mock, store, params)
+	if err != context.Canceled {
+		t.Errorf("Bad error of canceled run. Expected '%v', got '%v'", context.Canceled, err)
+	}
+	if state, _ := readState(params.stateFile); state != "b_avatar.png" || report.Processed != 1 || report.Failed != 0 {
+		t.Errorf("Bad canceled run. Got state '%v', report '%+v'", state, report)
+	}
+	mock = &reprocessorMock{}
+	if report, err = reprocess(ctx, mock, store, params); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"b", "c", "d", "y"}; !reflect.DeepEqual(mock.BaseIDs, expected) {
+		t.Errorf("Bad originals after cancel. Expected '%v', got '%v'", expected, mock.BaseIDs)
+	}
+
+	//ограничение скорости
+	params.stateFile = ""
+	params.rate = 50
+	mock = &reprocessorMock{}
+	start := time.Now()
+	if report, err = reprocess(ctx, mock, store, params); err != nil {
+		t.Fatal(err)
+	}
+	if report.Processed != 5 || time.Since(start) < 80*time.Millisecond {
+		t.Errorf("Bad throttled run. Processed '%v' in '%v'", report.Processed, time.Since(start))
+	}
+}
+
+func TestReprocessTenants(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	for _, name := range []string{"acme/a_original.jpeg", "acme/a_card.jpeg", "beta/b_original.png", "_/c_original.png"} {
+		store.Put(ctx, name, []byte(name))
+	}
+	layout, err := storage.NewLayout("{tenant}/{id}.{ext}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		Tenant          string
+		ExpectedTenants map[string]string
+	}{
+		{"", map[string]string{"a": "acme", "b": "beta", "c": ""}},
+		{"beta", map[string]string{"b": "beta"}},
+	}
+
+	for _, tCase := range testCases {
+		mock := &reprocessorMock{}
+		params := reprocessParams{
+			presets:     []string{"card"},
+			tenant:      tCase.Tenant,
+			layout:      layout,
+			concurrency: 2,
+			pageSize:    10,
+		}
+		if _, err := reprocess(ctx, mock, store, params); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(mock.Tenants, tCase.ExpectedTenants) {
+			t.Errorf("Bad tenants for '%v'. Expected '%v', got '%v'", tCase.Tenant, tCase.ExpectedTenants, mock.Tenants)
+		}
+	}
+}
@@ -47,6 +47,36 @@ const (
 	//RequestImgWorkerCount количество запускаемых воркеров для загрузки изображения по urls
 	RequestImgWorkerCount = "request_img_worker_count"
 
+	//ResizeWorkerMin и ResizeWorkerMax границы, в которых автоскейлер меняет число воркеров ресайза
+	ResizeWorkerMin = "resize_worker_min"
+	ResizeWorkerMax = "resize_worker_max"
+
+	//FileSaveWorkerMin и FileSaveWorkerMax границы числа воркеров сохранения
+	FileSaveWorkerMin = "file_save_worker_min"
+	FileSaveWorkerMax = "file_save_worker_max"
+
+	//RequestImgWorkerMin и RequestImgWorkerMax границы числа воркеров загрузки
+	RequestImgWorkerMin = "request_img_worker_min"
+	RequestImgWorkerMax = "request_img_worker_max"
+
+	//ResizeTargetLatencyMs, FileSaveTargetLatencyMs и RequestImgTargetLatencyMs сколько задача
+	//может занимать этап вместе с ожиданием в его очереди, прежде чем автоскейлер добавит воркеров
+	ResizeTargetLatencyMs     = "resize_target_latency_ms"
+	FileSaveTargetLatencyMs   = "file_save_target_latency_ms"
+	RequestImgTargetLatencyMs = "request_img_target_latency_ms"
+
+	//AutoscaleIntervalMs как часто автоскейлер пересматривает число воркеров
+	AutoscaleIntervalMs = "autoscale_interval_ms"
+
+	//AutoscaleUpOccupancyPct заполненность очереди этапа в процентах, при которой добавляются воркеры
+	AutoscaleUpOccupancyPct = "autoscale_up_occupancy_pct"
+
+	//AutoscaleDownOccupancyPct заполненность очереди, ниже которой этап считается спокойным
+	AutoscaleDownOccupancyPct = "autoscale_down_occupancy_pct"
+
+	//AutoscaleDownTicks сколько спокойных интервалов подряд нужно, чтобы убрать воркера
+	AutoscaleDownTicks = "autoscale_down_ticks"
+
 	//ResizeChannelSize размер канала для задач по ресайзу
 	ResizeChannelSize = "resize_channel_size"
 
@@ -56,12 +86,120 @@ const (
 	//RequestImgChannelSize размер канала для задач по загрузкам изображений по url
 	RequestImgChannelSize = "request_img_channel_size"
 
+	//ResizeChannelSize, FileSaveChannelSize и RequestImgChannelSize задают размер интерактивной полосы,
+	//а Bulk*ChannelSize - размер полосы массовой обработки того же этапа
+
+	//BulkResizeChannelSize размер полосы массовой обработки для задач по ресайзу
+	BulkResizeChannelSize = "bulk_resize_channel_size"
+
+	//BulkFileSaveChannelSize размер полосы массовой обработки для задач по сохранению файла
+	BulkFileSaveChannelSize = "bulk_file_save_channel_size"
+
+	//BulkRequestImgChannelSize размер полосы массовой обработки для задач по загрузкам изображений по url
+	BulkRequestImgChannelSize = "bulk_request_img_channel_size"
+
+	//InteractiveLaneWeight сколько интерактивных задач берёт этап на каждые BulkLaneWeight массовых
+	InteractiveLaneWeight = "interactive_lane_weight"
+
+	//BulkLaneWeight сколько массовых задач берёт этап на каждые InteractiveLaneWeight интерактивных
+	BulkLaneWeight = "bulk_lane_weight"
+
+	//PriorityAPIKeys полосы клиентов по ключу из заголовка X-API-Key, например "key1=bulk;key2=interactive"
+	PriorityAPIKeys = "priority_api_keys"
+
+	//BatchPriority полоса пакетных запросов, если она не указана в запросе
+	BatchPriority = "batch_priority"
+
+	//EnqueueWaitMs сколько ждать места в заполненной очереди, прежде чем отклонить задачу
+	EnqueueWaitMs = "enqueue_wait_ms"
+
+	//QueueFullStatus код ответа при заполненной очереди: 503 или 429
+	QueueFullStatus = "queue_full_status"
+
+	//MaxRetryAfterSec максимальное значение заголовка Retry-After при заполненной очереди
+	MaxRetryAfterSec = "max_retry_after_sec"
+
 	//JobTimeout таймаут ожидания выполнения задачи воркером в секундах
 	JobTimeoutSec = "job_timeout_sec"
 
 	//FileSaveDir директория для сохранения миниатюрок файлов
 	FileSaveDir = "file_save_dir"
 
+	//NamingMode именование миниатюр: random - случайный UUID, content - хэш изображения и параметров с дедупликацией
+	NamingMode = "naming_mode"
+
+	//StorageBackend хранилище миниатюр: local - директория FileSaveDir, memory - память процесса, s3 - S3-совместимый бакет
+	StorageBackend = "storage_backend"
+
+	//LocalSyncDir синхронизировать директорию после сохранения файла в local хранилище
+	LocalSyncDir = "local_sync_dir"
+
+	//RetentionMaxAgeSec максимальный возраст миниатюры в секундах. 0 - без ограничений
+	RetentionMaxAgeSec = "retention_max_age_sec"
+
+	//RetentionMaxBytes максимальный общий размер миниатюр в байтах. 0 - без ограничений
+	RetentionMaxBytes = "retention_max_bytes"
+
+	//RetentionMaxFiles максимальное количество файлов миниатюр. 0 - без ограничений
+	RetentionMaxFiles = "retention_max_files"
+
+	//RetentionPolicy какие миниатюры удалять при превышении лимитов: oldest - самые старые, lru - давно не читавшиеся
+	RetentionPolicy = "retention_policy"
+
+	//RetentionSweepIntervalSec интервал между проходами сборщика миниатюр в секундах
+	RetentionSweepIntervalSec = "retention_sweep_interval_sec"
+
+	//KeepOriginal сохранение исходного изображения вместе с миниатюрами: none, original - как есть,
+	//master - уменьшенная до OriginalMaxSide по большей стороне копия
+	KeepOriginal = "keep_original"
+
+	//OriginalMaxSide максимальная сторона мастер-копии исходного изображения
+	OriginalMaxSide = "original_max_side"
+
+	//ThumbnailsPageSize количество миниатюр на странице списка по умолчанию
+	ThumbnailsPageSize = "thumbnails_page_size"
+
+	//ThumbnailsMaxPageSize максимальное количество миниатюр на странице списка
+	ThumbnailsMaxPageSize = "thumbnails_max_page_size"
+
+	//StorageLayout раскладка файлов в хранилище: flat, sharded, dated или шаблон пути,
+	//например "{tenant}/{shard}/{id}.{ext}". Подстановки: {id}, {base_id}, {shard}, {preset}, {width}, {height},
+	//{tenant}, {yyyy}, {mm}, {dd}, {ext}
+	StorageLayout = "storage_layout"
+
+	//S3Endpoint адрес S3-совместимого сервиса
+	S3Endpoint = "s3_endpoint"
+
+	//S3Region регион бакета
+	S3Region = "s3_region"
+
+	//S3Bucket бакет для миниатюр
+	S3Bucket = "s3_bucket"
+
+	//S3Prefix префикс ключей миниатюр в бакете
+	S3Prefix = "s3_prefix"
+
+	//S3AccessKey ключ доступа к S3
+	S3AccessKey = "s3_access_key"
+
+	//S3SecretKey секретный ключ доступа к S3
+	S3SecretKey = "s3_secret_key"
+
+	//S3SessionToken токен временных ключей доступа к S3
+	S3SessionToken = "s3_session_token"
+
+	//S3ACL canned ACL сохраняемых миниатюр, например public-read
+	S3ACL = "s3_acl"
+
+	//S3CacheControl заголовок Cache-Control сохраняемых миниатюр
+	S3CacheControl = "s3_cache_control"
+
+	//S3PathStyle указывать бакет в пути запроса, а не в имени хоста
+	S3PathStyle = "s3_path_style"
+
+	//S3PartSizeByte размер части multipart загрузки. Файлы больше него загружаются по частям
+	S3PartSizeByte = "s3_part_size_byte"
+
 	//MaxImageSizeByte максимально допустимый размер изображения в байтах
 	MaxImageSizeByte = "max_image_size_byte"
 
@@ -93,6 +231,88 @@ const (
 	MaxIdleConnsPerHost = "max_idle_conns_per_host"
 
 	ServerRunAddress = "server_addr"
+
+	//DefaultThumbnailWidth ширина миниатюры, если она не указана в запросе
+	DefaultThumbnailWidth = "default_thumbnail_width"
+
+	//DefaultThumbnailHeight высота миниатюры, если она не указана в запросе
+	DefaultThumbnailHeight = "default_thumbnail_height"
+
+	//DefaultResizeMode способ ресайза, если он не указан в запросе: crop, fit, stretch или pad
+	DefaultResizeMode = "default_resize_mode"
+
+	//MinThumbnailSize минимально допустимая ширина и высота миниатюры в пикселях
+	MinThumbnailSize = "min_thumbnail_size"
+
+	//MaxThumbnailSize максимально допустимая ширина и высота миниатюры в пикселях
+	MaxThumbnailSize = "max_thumbnail_size"
+
+	//MaxVariants максимальное количество миниатюр, создаваемых из одного изображения за запрос
+	MaxVariants = "max_variants"
+
+	//OutputQuality качество jpeg и webp миниатюр, если оно не указано в запросе
+	OutputQuality = "output_quality"
+
+	//PNGCompression уровень сжатия png миниатюр от 1 до 9, если он не указан в запросе
+	PNGCompression = "png_compression"
+
+	//ResizeURLKeys ключи в hex через запятую для подписи ссылок /resize/. Без ключей ссылки не работают
+	ResizeURLKeys = "resize_url_keys"
+
+	//ResizeURLSalt соль в hex, добавляемая к подписываемому пути ссылок /resize/
+	ResizeURLSalt = "resize_url_salt"
+
+	//ResizeURLCache сохранять миниатюры, созданные по ссылкам /resize/, и отдавать их повторно
+	ResizeURLCache = "resize_url_cache"
+
+	//Presets именованные наборы параметров миниатюр через ";", например "avatar=64x64 crop;card=320x200 fit"
+	Presets = "presets"
+
+	//StrictPresets разрешить создавать миниатюры только по известным пресетам
+	StrictPresets = "strict_presets"
+
+	//AsyncJobTimeoutSec таймаут выполнения асинхронной задачи в секундах
+	AsyncJobTimeoutSec = "async_job_timeout_sec"
+
+	//JobTTLSec время в секундах, в течение которого хранится состояние завершённой асинхронной задачи
+	JobTTLSec = "job_ttl_sec"
+
+	//ShutdownGraceSec сколько ждать завершения запросов и задач пайплайна при остановке сервиса
+	ShutdownGraceSec = "shutdown_grace_sec"
+
+	//ServerReadTimeoutSec таймаут чтения запроса сервером в секундах
+	ServerReadTimeoutSec = "server_read_timeout_sec"
+
+	//ServerWriteTimeoutSec таймаут записи ответа сервером в секундах
+	ServerWriteTimeoutSec = "server_write_timeout_sec"
+
+	//PublicURL внешний адрес сервиса, используется в ссылках на миниатюры в callback
+	PublicURL = "public_url"
+
+	//CallbackSecret ключ для подписи callback асинхронных задач. Без ключа callback не подписывается
+	CallbackSecret = "callback_secret"
+
+	//CallbackMaxAttempts количество попыток отправить callback
+	CallbackMaxAttempts = "callback_max_attempts"
+
+	//CallbackRetryDelayMs задержка перед повторной отправкой callback в миллисекундах, удваивается с каждой попыткой
+	CallbackRetryDelayMs = "callback_retry_delay_ms"
+
+	//CallbackDeadLetterFile файл, в который пишутся неотправленные callback. По умолчанию они пишутся в лог
+	CallbackDeadLetterFile = "callback_dead_letter_file"
+
+	//MaxBatchItems максимальное количество элементов в json массиве пакетного запроса
+	MaxBatchItems = "max_batch_items"
+
+	//MaxBatchBodyByte максимальный размер json массива пакетного запроса в байтах
+	MaxBatchBodyByte = "max_batch_body_byte"
+
+	//BatchConcurrency количество одновременно обрабатываемых элементов одного пакетного запроса
+	BatchConcurrency = "batch_concurrency"
+
+	//BatchTimeoutSec сколько может читаться и отдаваться пакетный запрос вместо серверных
+	//таймаутов чтения и записи, 0 - без ограничения
+	BatchTimeoutSec = "batch_timeout_sec"
 )
 
 func init() {
@@ -100,34 +320,123 @@ func init() {
 	viper.SetDefault(ResizeWorkerCount, 10)
 	viper.SetDefault(FileSaveWorkerCount, 10)
 	viper.SetDefault(RequestImgWorkerCount, 100)
+	//по умолчанию границы совпадают с начальным числом воркеров и автоскейлер выключен
+	viper.SetDefault(ResizeWorkerMin, viper.GetInt(ResizeWorkerCount))
+	viper.SetDefault(ResizeWorkerMax, viper.GetInt(ResizeWorkerCount))
+	viper.SetDefault(FileSaveWorkerMin, viper.GetInt(FileSaveWorkerCount))
+	viper.SetDefault(FileSaveWorkerMax, viper.GetInt(FileSaveWorkerCount))
+	viper.SetDefault(RequestImgWorkerMin, viper.GetInt(RequestImgWorkerCount))
+	viper.SetDefault(RequestImgWorkerMax, viper.GetInt(RequestImgWorkerCount))
+	viper.SetDefault(ResizeTargetLatencyMs, 1000)
+	viper.SetDefault(FileSaveTargetLatencyMs, 200)
+	viper.SetDefault(RequestImgTargetLatencyMs, 3000)
+	viper.SetDefault(AutoscaleIntervalMs, 1000)
+	viper.SetDefault(AutoscaleUpOccupancyPct, 50)
+	viper.SetDefault(AutoscaleDownOccupancyPct, 10)
+	viper.SetDefault(AutoscaleDownTicks, 5)
 	viper.SetDefault(ResizeChannelSize,
 		viper.GetInt(ResizeWorkerCount))
 	viper.SetDefault(FileSaveChannelSize,
 		viper.GetInt(FileSaveWorkerCount))
 	viper.SetDefault(RequestImgChannelSize,
 		viper.GetInt(RequestImgWorkerCount))
+	viper.SetDefault(BulkResizeChannelSize,
+		viper.GetInt(ResizeChannelSize))
+	viper.SetDefault(BulkFileSaveChannelSize,
+		viper.GetInt(FileSaveChannelSize))
+	viper.SetDefault(BulkRequestImgChannelSize,
+		viper.GetInt(RequestImgChannelSize))
+	viper.SetDefault(InteractiveLaneWeight, 4)
+	viper.SetDefault(BulkLaneWeight, 1)
+	viper.SetDefault(PriorityAPIKeys, "")
+	viper.SetDefault(BatchPriority, "bulk")
 	viper.SetDefault(JobTimeoutSec, 10)
 	viper.SetDefault(IdleConnTimeoutSec, 90)
+	viper.SetDefault(EnqueueWaitMs, 100)
+	viper.SetDefault(QueueFullStatus, 503)
+	viper.SetDefault(MaxRetryAfterSec, 60)
 	viper.SetDefault(MaxIdleConns, 100)
 	viper.SetDefault(MaxIdleConnsPerHost, 100)
 	viper.SetDefault(FileSaveDir, "./thumbnails")
+	viper.SetDefault(NamingMode, "random")
+	viper.SetDefault(StorageBackend, "local")
+	viper.SetDefault(StorageLayout, "flat")
+	viper.SetDefault(LocalSyncDir, false)
+	viper.SetDefault(RetentionMaxAgeSec, 0)
+	viper.SetDefault(RetentionMaxBytes, 0)
+	viper.SetDefault(RetentionMaxFiles, 0)
+	viper.SetDefault(RetentionPolicy, "oldest")
+	viper.SetDefault(RetentionSweepIntervalSec, 300)
+	viper.SetDefault(ThumbnailsPageSize, 100)
+	viper.SetDefault(KeepOriginal, "none")
+	viper.SetDefault(OriginalMaxSide, 2048)
+	viper.SetDefault(ThumbnailsMaxPageSize, 1000)
+	viper.SetDefault(S3Endpoint, "https://s3.amazonaws.com")
+	viper.SetDefault(S3Region, "us-east-1")
+	viper.SetDefault(S3Bucket, "")
+	viper.SetDefault(S3Prefix, "")
+	viper.SetDefault(S3AccessKey, "")
+	viper.SetDefault(S3SecretKey, "")
+	viper.SetDefault(S3SessionToken, "")
+	viper.SetDefault(S3ACL, "")
+	viper.SetDefault(S3CacheControl, "")
+	viper.SetDefault(S3PathStyle, true)
+	viper.SetDefault(S3PartSizeByte, 8*1024*1024)
 	viper.SetDefault(MaxImageSizeByte, 15*1024*1024)
 	viper.SetDefault(ServerRunAddress, "localhost:3000")
-	makeImgSaveDir()
+	viper.SetDefault(DefaultThumbnailWidth, 100)
+	viper.SetDefault(DefaultThumbnailHeight, 100)
+	viper.SetDefault(DefaultResizeMode, "crop")
+	viper.SetDefault(MinThumbnailSize, 16)
+	viper.SetDefault(MaxThumbnailSize, 2048)
+	viper.SetDefault(MaxVariants, 10)
+	viper.SetDefault(OutputQuality, 90)
+	viper.SetDefault(PNGCompression, 6)
+	viper.SetDefault(ResizeURLKeys, "")
+	viper.SetDefault(ResizeURLSalt, "")
+	viper.SetDefault(ResizeURLCache, false)
+	viper.SetDefault(Presets, "")
+	viper.SetDefault(StrictPresets, false)
+	viper.SetDefault(AsyncJobTimeoutSec, 300)
+	viper.SetDefault(JobTTLSec, 3600)
+	viper.SetDefault(ShutdownGraceSec, 30)
+	viper.SetDefault(ServerReadTimeoutSec, 10)
+	viper.SetDefault(ServerWriteTimeoutSec, 10)
+	viper.SetDefault(PublicURL, "")
+	viper.SetDefault(CallbackSecret, "")
+	viper.SetDefault(CallbackMaxAttempts, 5)
+	viper.SetDefault(CallbackRetryDelayMs, 1000)
+	viper.SetDefault(CallbackDeadLetterFile, "")
+	viper.SetDefault(MaxBatchItems, 1000)
+	viper.SetDefault(MaxBatchBodyByte, 64*1024*1024)
+	viper.SetDefault(BatchConcurrency, 50)
+	viper.SetDefault(BatchTimeoutSec, 3600)
+	//директория нужна только локальному хранилищу
+	if GetString(StorageBackend) == "local" {
+		makeImgSaveDir()
+	}
 
+	transport := &http.Transport{
+		IdleConnTimeout:     time.Second * GetDuration(IdleConnTimeoutSec),
+		MaxIdleConns:        GetInt(MaxIdleConns),
+		MaxIdleConnsPerHost: GetInt(MaxIdleConnsPerHost),
+	}
 	HTTPClient = &http.Client{
-		Transport: &http.Transport{
-			IdleConnTimeout:     time.Second * GetDuration(IdleConnTimeoutSec),
-			MaxIdleConns:        GetInt(MaxIdleConns),
-			MaxIdleConnsPerHost: GetInt(MaxIdleConnsPerHost),
-		},
-		Timeout: time.Second * GetDuration(JobTimeoutSec),
+		Transport: transport,
+		Timeout:   time.Second * GetDuration(JobTimeoutSec),
+	}
+	FetchHTTPClient = &http.Client{
+		Transport: transport,
 	}
 }
 
-//HTTPClient настроенный клиент
+//HTTPClient настроенный клиент для хранилища и callback
 var HTTPClient *http.Client
 
+//FetchHTTPClient клиент для загрузки исходников. Общего таймаута у него нет: загрузку ограничивает
+//контекст задачи, JobTimeoutSec для синхронных и AsyncJobTimeoutSec для асинхронных задач
+var FetchHTTPClient *http.Client
+
 func makeImgSaveDir() {
 	dir := GetString(FileSaveDir)
 	if _, err := os.Stat(dir); err != nil {
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"os"
+	"staply_img_resizer/cli"
 	serv "staply_img_resizer/server"
 )
 
 func main() {
-	serv.NewServer().Serve()
+	//staply_img_resizer reprocess -presets avatar,card пересоздаёт миниатюры из сохранённых исходников
+	if len(os.Args) > 1 && os.Args[1] == "reprocess" {
+		os.Exit(cli.Reprocess(os.Args[2:]))
+	}
+	os.Exit(serv.NewServer().Serve())
 }
@@ -0,0 +1,260 @@
+package resizer
+
+import (
+	"fmt"
+	"log"
+	"staply_img_resizer/config"
+	"sync"
+	"time"
+)
+
+//maxScaleDecisions сколько последних решений автоскейлера хранится для каждого этапа
+const maxScaleDecisions = 20
+
+//ScaleDecision решение автоскейлера об изменении числа воркеров этапа
+type ScaleDecision struct {
+	Time   time.Time `json:"time"`
+	From   int       `json:"from"`
+	To     int       `json:"to"`
+	Reason string    `json:"reason"`
+}
+
+//PoolStatus состояние пула воркеров этапа. LatencyMs - среднее время задачи от постановки
+//в очередь этапа до его завершения за последний интервал автоскейлера
+type PoolStatus struct {
+	Stage     string          `json:"stage"`
+	Workers   int             `json:"workers"`
+	Min       int             `json:"min"`
+	Max       int             `json:"max"`
+	QueueLen  int             `json:"queue_len"`
+	QueueCap  int             `json:"queue_cap"`
+	LatencyMs int64           `json:"latency_ms"`
+	Decisions []ScaleDecision `json:"decisions"`
+}
+
+//stageQueue очередь этапа, по заполненности которой масштабируется пул
+type stageQueue interface {
+	depth() int
+	capacity() int
+}
+
+//workerPool воркеры одного этапа. Автоскейлер меняет их число в пределах min..max:
+//новые воркеры запускаются, а лишние получают сигнал retire и завершаются,
+//когда им нечего делать. Очередь этапа при этом не закрывается
+type workerPool struct {
+	stage         string
+	initial       int
+	min           int
+	max           int
+	targetLatency time.Duration
+	queue         stageQueue
+	worker        func(p *workerPool)
+	wg            *sync.WaitGroup
+	retire        chan struct{}
+
+	mu        sync.Mutex
+	size      int
+	latency   time.Duration
+	finished  int
+	idleTicks int
+	last      time.Duration
+	decisions []ScaleDecision
+}
+
+func newWorkerPool(stage string, wg *sync.WaitGroup, queue stageQueue, countKey, minKey, maxKey, latencyKey string, worker func(p *workerPool)) *workerPool {
+	return &workerPool{
+		stage:         stage,
+		initial:       config.GetInt(countKey),
+		min:           config.GetInt(minKey),
+		max:           config.GetInt(maxKey),
+		targetLatency: time.Duration(config.GetInt(latencyKey)) * time.Millisecond,
+		queue:         queue,
+		worker:        worker,
+		wg:            wg,
+		retire:        make(chan struct{}, config.GetInt(maxKey)),
+	}
+}
+
+func (p *workerPool) check() error {
+	if p.min < 1 || p.max < p.min {
+		return fmt.Errorf("bad %s worker bounds: min %d, max %d", p.stage, p.min, p.max)
+	}
+	if p.targetLatency <= 0 {
+		return fmt.Errorf("%s target latency must be positive", p.stage)
+	}
+	return nil
+}
+
+//start запускает начальное число воркеров с учётом границ пула
+func (p *workerPool) start() {
+	count := p.initial
+	if count < p.min {
+		count = p.min
+	}
+	if count > p.max {
+		count = p.max
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resize(count)
+}
+
+//resize запускает или отправляет на покой воркеров до size. Вызывается под mu.
+//Сигнал retire забирает первый освободившийся воркер
+func (p *workerPool) resize(size int) {
+	for ; p.size < size; p.size++ {
+		p.wg.Add(1)
+		go p.worker(p)
+	}
+	for p.size > size {
+		select {
+		case p.retire <- struct{}{}:
+			p.size--
+		default:
+			//сигналы прошлых решений ещё не разобраны
+			return
+		}
+	}
+}
+
+//observe учитывает задачу, поставленную в очередь этапа в queued и только что обработанную
+func (p *workerPool) observe(queued time.Time) {
+	p.mu.Lock()
+	p.latency += time.Since(queued)
+	p.finished++
+	p.mu.Unlock()
+}
+
+//tick оценивает этап за прошедший интервал и при необходимости меняет число воркеров
+func (p *workerPool) tick(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.last = 0
+	if p.finished > 0 {
+		p.last = p.latency / time.Duration(p.finished)
+	}
+	p.latency, p.finished = 0, 0
+
+	size, reason := p.decide(p.queue.depth(), p.last)
+	if size == p.size {
+		return
+	}
+	var d = ScaleDecision{Time: now, From: p.size, Reason: reason}
+	p.resize(size)
+	if d.To = p.size; d.To == d.From {
+		return
+	}
+	p.decisions = append(p.decisions, d)
+	if len(p.decisions) > maxScaleDecisions {
+		p.decisions = p.decisions[len(p.decisions)-maxScaleDecisions:]
+	}
+	log.Printf("Autoscale %s workers: %d -> %d, %s", p.stage, d.From, d.To, d.Reason)
+}
+
+//decide новое число воркеров по глубине очереди и средней задержке этапа.
+//Пул растёт на четверть, когда очередь заполнена больше чем на AutoscaleUpOccupancyPct
+//или задачи ждут дольше targetLatency, и уменьшается на одного воркера
+//после AutoscaleDownTicks спокойных интервалов подряд
+func (p *workerPool) decide(depth int, latency time.Duration) (int, string) {
+	var occupancy int
+	if c := p.queue.capacity(); c > 0 {
+		occupancy = depth * 100 / c
+	}
+
+	var reason string
+	switch {
+	case occupancy >= config.GetInt(config.AutoscaleUpOccupancyPct):
+		reason = fmt.Sprintf("queue is %d%% full", occupancy)
+	case depth > 0 && latency > p.targetLatency:
+		reason = fmt.Sprintf("latency %v is over %v", latency.Round(time.Millisecond), p.targetLatency)
+	}
+	if reason != "" {
+		p.idleTicks = 0
+		if p.size >= p.max {
+			return p.size, ""
+		}
+		step := p.size / 4
+		if step < 1 {
+			step = 1
+		}
+		if p.size+step > p.max {
+			step = p.max - p.size
+		}
+		return p.size + step, reason
+	}
+
+	if occupancy > config.GetInt(config.AutoscaleDownOccupancyPct) || latency > p.targetLatency/2 {
+		p.idleTicks = 0
+		return p.size, ""
+	}
+	p.idleTicks++
+	if p.size <= p.min || p.idleTicks < config.GetInt(config.AutoscaleDownTicks) {
+		return p.size, ""
+	}
+	p.idleTicks = 0
+	return p.size - 1, fmt.Sprintf("idle for %d intervals, queue is %d%% full, latency %v",
+		config.GetInt(config.AutoscaleDownTicks), occupancy, latency.Round(time.Millisecond))
+}
+
+func (p *workerPool) status() PoolStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStatus{
+		Stage:     p.stage,
+		Workers:   p.size,
+		Min:       p.min,
+		Max:       p.max,
+		QueueLen:  p.queue.depth(),
+		QueueCap:  p.queue.capacity(),
+		LatencyMs: int64(p.last / time.Millisecond),
+		Decisions: append([]ScaleDecision(nil), p.decisions...),
+	}
+}
+
+func checkAutoscale(pools []*workerPool) error {
+	for _, p := range pools {
+		if err := p.check(); err != nil {
+			return err
+		}
+	}
+	if config.GetInt(config.AutoscaleIntervalMs) < 1 {
+		return fmt.Errorf("autoscale interval must be positive")
+	}
+	if config.GetInt(config.AutoscaleDownOccupancyPct) >= config.GetInt(config.AutoscaleUpOccupancyPct) {
+		return fmt.Errorf("autoscale down occupancy must be less than up occupancy")
+	}
+	return nil
+}
+
+//startAutoscaler раз в AutoscaleIntervalMs пересматривает размеры пулов, пока не закрыт stop.
+//Если у всех пулов min и max совпадают, размеры фиксированы и автоскейлер не запускается
+func startAutoscaler(wg *sync.WaitGroup, pools []*workerPool, stop <-chan struct{}) {
+	var scalable bool
+	for _, p := range pools {
+		scalable = scalable || p.min < p.max
+	}
+	if !scalable {
+		log.Printf("Autoscaling is disabled: worker counts are fixed")
+		return
+	}
+
+	interval := time.Duration(config.GetInt(config.AutoscaleIntervalMs)) * time.Millisecond
+	log.Printf("Autoscaler is running every %v", interval)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				for _, p := range pools {
+					p.tick(now)
+				}
+			}
+		}
+	}()
+}
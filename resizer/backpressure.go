@@ -0,0 +1,104 @@
+package resizer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"staply_img_resizer/config"
+	"sync"
+	"time"
+)
+
+//QueueFullError задача отклонена, потому что очередь пайплайна заполнена
+type QueueFullError struct {
+	//Queue имя очереди: request или resize
+	Queue string
+	//Depth количество задач в очереди
+	Depth int
+	//RetryAfter через сколько очередь, судя по текущей пропускной способности, освободится
+	RetryAfter time.Duration
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("The %s queue is full", e.Queue)
+}
+
+//errNoSpace в полосе очереди не освободилось место
+var errNoSpace = fmt.Errorf("no space in the queue")
+
+//rateWindow за сколько последних секунд считается пропускная способность
+const rateWindow = 10
+
+//rateMeter считает завершённые задачи за последние rateWindow секунд
+type rateMeter struct {
+	mu      sync.Mutex
+	buckets [rateWindow]int
+	//seconds секунда, к которой относится каждая корзина
+	seconds [rateWindow]int64
+}
+
+func (m *rateMeter) add(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sec := now.Unix()
+	i := sec % rateWindow
+	if sec < m.seconds[i] {
+		return
+	}
+	if m.seconds[i] != sec {
+		m.seconds[i] = sec
+		m.buckets[i] = 0
+	}
+	m.buckets[i]++
+}
+
+//rate задач в секунду за последние rateWindow секунд
+func (m *rateMeter) rate(now time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var count int
+	for i, sec := range m.seconds {
+		if now.Unix()-sec < rateWindow {
+			count += m.buckets[i]
+		}
+	}
+	return float64(count) / rateWindow
+}
+
+//retryAfter оценивает, когда обработается очередь из depth задач при текущей пропускной способности.
+//Результат от секунды до config.MaxRetryAfterSec
+func retryAfter(depth int, rate float64) time.Duration {
+	max := time.Second * config.GetDuration(config.MaxRetryAfterSec)
+	if rate <= 0 {
+		return max
+	}
+	wait := time.Second * time.Duration(math.Ceil(float64(depth+1)/rate))
+	if wait > max {
+		return max
+	}
+	if wait < time.Second {
+		return time.Second
+	}
+	return wait
+}
+
+func enqueueWait() time.Duration {
+	return time.Millisecond * config.GetDuration(config.EnqueueWaitMs)
+}
+
+type queueWaitKey struct{}
+
+//WithQueueWait возвращает контекст внутренней задачи сервиса, например элемента пакета или перегенерации.
+//Такая задача ждёт места в очереди, пока не отменён ctx, а не получает *QueueFullError через EnqueueWaitMs
+func WithQueueWait(ctx context.Context) context.Context {
+	return context.WithValue(ctx, queueWaitKey{}, true)
+}
+
+//queueTimeout сигнал отказа в постановке в очередь через wait. Для WithQueueWait - nil
+func queueTimeout(ctx context.Context, wait time.Duration) (<-chan time.Time, func()) {
+	if waits, _ := ctx.Value(queueWaitKey{}).(bool); waits {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(wait)
+	return timer.C, func() { timer.Stop() }
+}
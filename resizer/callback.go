@@ -0,0 +1,163 @@
+package resizer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"staply_img_resizer/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	callbackClient = config.HTTPClient
+}
+
+var callbackClient CallbackClient
+
+//CallbackClient клиент для отправки callback асинхронных задач
+type CallbackClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+//SignatureHeader заголовок с подписью тела callback: "sha256=" и hex HMAC-SHA256 с ключом config.CallbackSecret
+const SignatureHeader = "X-Signature"
+
+type callbackPayload struct {
+	ID         string              `json:"id"`
+	Status     JobState            `json:"status"`
+	Thumbnails []callbackThumbnail `json:"thumbnails,omitempty"`
+	Error      string              `json:"error,omitempty"`
+}
+
+type callbackThumbnail struct {
+	ID      string `json:"id"`
+	Variant string `json:"variant,omitempty"`
+	URL     string `json:"url"`
+}
+
+//deadLetterMu защищает запись в config.CallbackDeadLetterFile
+var deadLetterMu sync.Mutex
+
+//sendCallback отправляет результат задачи на url. При ошибке повторяет отправку
+//с экспоненциальной задержкой, а после config.CallbackMaxAttempts попыток или отмены ctx
+//пишет callback в dead letter
+func sendCallback(ctx context.Context, url string, job JobStatus) {
+	var payload = callbackPayload{
+		ID:     job.ID,
+		Status: job.Status,
+		Error:  job.Error,
+	}
+	for _, res := range job.Results {
+		payload.Thumbnails = append(payload.Thumbnails, callbackThumbnail{
+			ID:      res.ID,
+			Variant: res.Variant,
+			URL:     strings.TrimSuffix(config.GetString(config.PublicURL), "/") + "/thumbnails/" + res.Path,
+		})
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("can't marshal callback for job %s; error %v", job.ID, err)
+		return
+	}
+
+	var delay = time.Millisecond * config.GetDuration(config.CallbackRetryDelayMs)
+	var attempts = config.GetInt(config.CallbackMaxAttempts)
+	for i := 1; ; i++ {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		err = postCallback(ctx, url, body)
+		if err == nil {
+			return
+		}
+		if i >= attempts {
+			break
+		}
+		log.Printf("callback for job %s failed (attempt %d of %d); error %v", job.ID, i, attempts, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		delay *= 2
+	}
+
+	deadLetter(url, body, err)
+}
+
+func postCallback(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if secret := config.GetString(config.CallbackSecret); secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+SignCallback([]byte(secret), body))
+	}
+
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+//SignCallback возвращает hex HMAC-SHA256 тела callback
+func SignCallback(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//deadLetter сохраняет неотправленный callback строкой json в config.CallbackDeadLetterFile или в лог
+func deadLetter(url string, body []byte, reason error) {
+	line, _ := json.Marshal(struct {
+		URL     string          `json:"url"`
+		Payload json.RawMessage `json:"payload"`
+		Error   string          `json:"error"`
+		Time    time.Time       `json:"time"`
+	}{
+		URL:     url,
+		Payload: body,
+		Error:   reason.Error(),
+		Time:    time.Now(),
+	})
+
+	file := config.GetString(config.CallbackDeadLetterFile)
+	if file == "" {
+		log.Printf("callback dead letter: %s", line)
+		return
+	}
+
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("can't open dead letter file %s; error %v; callback dead letter: %s", file, err, line)
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		log.Printf("can't write dead letter file %s; error %v; callback dead letter: %s", file, err, line)
+	}
+}
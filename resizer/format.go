@@ -0,0 +1,142 @@
+package resizer
+
+import (
+	"fmt"
+	"staply_img_resizer/config"
+
+	"github.com/davidbyttow/govips/pkg/vips"
+)
+
+//Format формат, в который кодируется миниатюра
+type Format string
+
+const (
+	//FormatAuto формат выбирается сервисом. Пустое значение работает так же
+	FormatAuto Format = "auto"
+	FormatJPEG Format = "jpeg"
+	FormatPNG  Format = "png"
+	FormatWEBP Format = "webp"
+	FormatAVIF Format = "avif"
+)
+
+//formatTypes форматы, которые умеет кодировать vips.
+//AVIF в используемой версии vips не поддерживается
+var formatTypes = map[Format]vips.ImageType{
+	FormatJPEG: vips.ImageTypeJPEG,
+	FormatPNG:  vips.ImageTypePNG,
+	FormatWEBP: vips.ImageTypeWEBP,
+}
+
+func (f Format) validate() error {
+	switch f {
+	case "", FormatAuto:
+		return nil
+	case FormatAVIF:
+		return fmt.Errorf("format '%s' is not supported by vips", f)
+	}
+	if _, ok := formatTypes[f]; !ok {
+		return fmt.Errorf("unknown format '%s'", f)
+	}
+	return nil
+}
+
+//encoderType возвращает тип, в который будет закодирована миниатюра.
+//Для auto выбирается первый поддерживаемый формат из Accept, иначе PNG для изображений
+//с прозрачностью и JPEG для остальных.
+//Без явного формата используется формат исходного изображения,
+//а форматы, которые vips не умеет кодировать, сохраняются в JPEG
+func (o Options) encoderType(src *vips.ImageRef) vips.ImageType {
+	types := o.encoderTypes(src.Format())
+	if len(types) > 1 && !hasAlpha(src) {
+		return types[1]
+	}
+	return types[0]
+}
+
+//encoderTypes типы, в которые может быть закодирована миниатюра исходника типа srcType.
+//Их два только для auto без Accept: PNG, если у исходника есть прозрачность, и JPEG
+func (o Options) encoderTypes(srcType vips.ImageType) []vips.ImageType {
+	if t, ok := formatTypes[o.Format]; ok {
+		return []vips.ImageType{t}
+	}
+
+	if o.Format == FormatAuto {
+		for _, f := range o.Accept {
+			if t, ok := formatTypes[f]; ok {
+				return []vips.ImageType{t}
+			}
+		}
+		return []vips.ImageType{vips.ImageTypePNG, vips.ImageTypeJPEG}
+	}
+
+	switch srcType {
+	case vips.ImageTypePNG, vips.ImageTypeWEBP:
+		return []vips.ImageType{srcType}
+	}
+	return []vips.ImageType{vips.ImageTypeJPEG}
+}
+
+//FixedFormat формат миниатюры, если он известен без исходного изображения:
+//задан явно или выбран из Accept для auto. Иначе пустая строка
+func (o Options) FixedFormat() Format {
+	if _, ok := formatTypes[o.Format]; ok {
+		return o.Format
+	}
+	if o.Format == FormatAuto {
+		for _, f := range o.Accept {
+			if _, ok := formatTypes[f]; ok {
+				return f
+			}
+		}
+	}
+	return ""
+}
+
+//hasAlpha есть ли у изображения альфа-канал: серый или sRGB с прозрачностью
+func hasAlpha(img *vips.ImageRef) bool {
+	return img.Bands() == 2 || img.Bands() == 4
+}
+
+//validateEncoder проверяет параметры кодирования
+func (o Options) validateEncoder() error {
+	if err := o.Format.validate(); err != nil {
+		return err
+	}
+	if o.Quality < 0 || o.Quality > 100 {
+		return fmt.Errorf("quality %d is out of bounds [1, 100]", o.Quality)
+	}
+	if o.Compression < 0 || o.Compression > 9 {
+		return fmt.Errorf("compression %d is out of bounds [1, 9]", o.Compression)
+	}
+	if o.Lossless && o.Format != FormatWEBP {
+		return fmt.Errorf("lossless is supported only for webp")
+	}
+	if o.Progressive && o.Format != FormatJPEG && o.Format != FormatPNG {
+		return fmt.Errorf("progressive is supported only for jpeg and png")
+	}
+	return nil
+}
+
+//applyEncoder настраивает кодирование миниатюры
+func (o Options) applyEncoder(t *vips.Transform, src *vips.ImageRef) {
+	t.Format(o.encoderType(src))
+
+	quality := o.Quality
+	if quality == 0 {
+		quality = config.GetInt(config.OutputQuality)
+	}
+	t.Quality(quality)
+
+	compression := o.Compression
+	if compression == 0 {
+		compression = config.GetInt(config.PNGCompression)
+	}
+	t.Compression(compression)
+
+	if o.Progressive {
+		t.Interlaced()
+	}
+	if o.Lossless {
+		t.Lossless()
+	}
+}
@@ -0,0 +1,68 @@
+package resizer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+
+	"github.com/davidbyttow/govips/pkg/vips"
+)
+
+//headerSize размеры изображения типа t. Для JPEG, PNG и WEBP читается только заголовок,
+//остальные форматы читаются целиком и декодируются
+func headerSize(r io.Reader, t vips.ImageType) (int, int, error) {
+	var cfg image.Config
+	var err error
+	switch t {
+	case vips.ImageTypeJPEG:
+		cfg, err = jpeg.DecodeConfig(r)
+	case vips.ImageTypePNG:
+		cfg, err = png.DecodeConfig(r)
+	case vips.ImageTypeWEBP:
+		return webpSize(r)
+	default:
+		img, err := ioutil.ReadAll(r)
+		if err != nil {
+			return 0, 0, err
+		}
+		return imgSize(img)
+	}
+	return cfg.Width, cfg.Height, err
+}
+
+//webpSize размеры WEBP из заголовка первого чанка: VP8X для расширенного формата,
+//VP8 для сжатия с потерями и VP8L для сжатия без потерь
+func webpSize(r io.Reader) (int, int, error) {
+	var h [30]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, 0, fmt.Errorf("bad webp header; error %v", err)
+	}
+	if string(h[0:4]) != "RIFF" || string(h[8:12]) != "WEBP" {
+		return 0, 0, fmt.Errorf("bad webp header")
+	}
+
+	switch string(h[12:16]) {
+	case "VP8X":
+		width := int(h[24]) | int(h[25])<<8 | int(h[26])<<16
+		height := int(h[27]) | int(h[28])<<8 | int(h[29])<<16
+		return width + 1, height + 1, nil
+	case "VP8 ":
+		if h[23] != 0x9d || h[24] != 0x01 || h[25] != 0x2a {
+			return 0, 0, fmt.Errorf("bad webp vp8 start code")
+		}
+		width := binary.LittleEndian.Uint16(h[26:28]) & 0x3fff
+		height := binary.LittleEndian.Uint16(h[28:30]) & 0x3fff
+		return int(width), int(height), nil
+	case "VP8L":
+		if h[20] != 0x2f {
+			return 0, 0, fmt.Errorf("bad webp vp8l signature")
+		}
+		bits := binary.LittleEndian.Uint32(h[21:25])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, nil
+	}
+	return 0, 0, fmt.Errorf("unknown webp chunk '%s'", h[12:16])
+}
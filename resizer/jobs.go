@@ -0,0 +1,131 @@
+package resizer
+
+import (
+	"fmt"
+	"staply_img_resizer/config"
+	"sync"
+	"time"
+)
+
+//JobState состояние асинхронной задачи
+type JobState string
+
+const (
+	JobQueued   JobState = "queued"
+	JobFetching JobState = "fetching"
+	JobResizing JobState = "resizing"
+	JobSaving   JobState = "saving"
+	JobDone     JobState = "done"
+	JobFailed   JobState = "failed"
+)
+
+//JobStatus описание асинхронной задачи
+type JobStatus struct {
+	ID      string    `json:"id"`
+	Status  JobState  `json:"status"`
+	Results []*Result `json:"results,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+//jobStore хранит асинхронные задачи. Завершённые задачи удаляются через config.JobTTLSec
+type jobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*JobStatus
+}
+
+func newJobStore() *jobStore {
+	return &jobStore{
+		jobs: make(map[string]*JobStatus),
+	}
+}
+
+func (s *jobStore) create() (string, error) {
+	id, err := genName()
+	if err != nil {
+		return "", fmt.Errorf("can't gen job id; error %v", err)
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purge(now)
+	s.jobs[id] = &JobStatus{
+		ID:      id,
+		Status:  JobQueued,
+		Created: now,
+		Updated: now,
+	}
+	return id, nil
+}
+
+//remove удаляет задачу, которую не удалось поставить в очередь
+func (s *jobStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+}
+
+//get возвращает копию состояния задачи
+func (s *jobStore) get(id string) (JobStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purge(time.Now())
+	job, ok := s.jobs[id]
+	if !ok {
+		return JobStatus{}, false
+	}
+	return *job, true
+}
+
+func (s *jobStore) setState(id string, state JobState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[id]; ok && job.Status != JobDone && job.Status != JobFailed {
+		job.Status = state
+		job.Updated = time.Now()
+	}
+}
+
+//finish завершает задачу и возвращает её итоговое состояние
+func (s *jobStore) finish(id string, results []*Result, err error) JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		job = &JobStatus{ID: id, Created: time.Now()}
+	}
+	job.Updated = time.Now()
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = JobDone
+		job.Results = results
+	}
+	return *job
+}
+
+//purge удаляет завершённые задачи старше config.JobTTLSec. Вызывается под мьютексом
+func (s *jobStore) purge(now time.Time) {
+	ttl := time.Second * config.GetDuration(config.JobTTLSec)
+	for id, job := range s.jobs {
+		if (job.Status == JobDone || job.Status == JobFailed) && now.Sub(job.Updated) > ttl {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+//jobTracker передаётся вместе с задачей по пайплайну и отмечает стадии асинхронной задачи.
+//Для синхронных задач store пустой
+type jobTracker struct {
+	store *jobStore
+	id    string
+}
+
+func (t jobTracker) set(state JobState) {
+	if t.store != nil {
+		t.store.setState(t.id, state)
+	}
+}
@@ -0,0 +1,203 @@
+package resizer
+
+import (
+	"context"
+	"fmt"
+	"staply_img_resizer/config"
+	"sync"
+	"time"
+)
+
+//Priority полоса пайплайна, в которой выполняется задача
+type Priority string
+
+const (
+	//PriorityInteractive задачи, которых ждёт пользователь. Обслуживаются в первую очередь
+	PriorityInteractive Priority = "interactive"
+	//PriorityBulk массовая обработка, например импорт каталога
+	PriorityBulk Priority = "bulk"
+)
+
+//Индексы полос в очередях этапов
+const (
+	laneInteractive = iota
+	laneBulk
+	laneCount
+)
+
+//ParsePriority проверяет имя полосы. Пустая строка - полоса не указана
+func ParsePriority(s string) (Priority, error) {
+	switch p := Priority(s); p {
+	case "", PriorityInteractive, PriorityBulk:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown priority '%s'", s)
+	}
+}
+
+type priorityKey struct{}
+
+//WithPriority возвращает контекст задачи, выполняемой в полосе p
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+//PriorityFrom полоса задачи с контекстом ctx. По умолчанию - интерактивная
+func PriorityFrom(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok && p != "" {
+		return p
+	}
+	return PriorityInteractive
+}
+
+func laneOf(ctx context.Context) int {
+	if PriorityFrom(ctx) == PriorityBulk {
+		return laneBulk
+	}
+	return laneInteractive
+}
+
+func checkLanes() error {
+	if config.GetInt(config.InteractiveLaneWeight) < 1 || config.GetInt(config.BulkLaneWeight) < 1 {
+		return fmt.Errorf("lane weights must be positive")
+	}
+	return nil
+}
+
+//lanePicker выбирает полосу для следующей задачи этапа по взвешенному кругу:
+//на InteractiveLaneWeight интерактивных задач приходится BulkLaneWeight массовых,
+//поэтому массовые задачи не простаивают даже под постоянной интерактивной нагрузкой
+type lanePicker struct {
+	mu  sync.Mutex
+	seq []int
+	pos int
+}
+
+func newLanePicker(interactive, bulk int) *lanePicker {
+	var p lanePicker
+	//полосы чередуются, чтобы массовые задачи не шли пачкой
+	for i, b := 0, 0; i < interactive || b < bulk; {
+		if i*bulk <= b*interactive && i < interactive {
+			p.seq = append(p.seq, laneInteractive)
+			i++
+		} else {
+			p.seq = append(p.seq, laneBulk)
+			b++
+		}
+	}
+	return &p
+}
+
+//order порядок, в котором опрашиваются полосы для следующей задачи
+func (p *lanePicker) order() [laneCount]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	first := p.seq[p.pos]
+	p.pos = (p.pos + 1) % len(p.seq)
+	return [laneCount]int{first, laneCount - 1 - first}
+}
+
+func pickerFromConfig() *lanePicker {
+	return newLanePicker(config.GetInt(config.InteractiveLaneWeight), config.GetInt(config.BulkLaneWeight))
+}
+
+//laneJob задача, которую можно поставить в очередь с полосами. queuedAt возвращает копию задачи
+//с временем постановки в очередь
+type laneJob[T any] interface {
+	queuedAt(t time.Time) T
+}
+
+func (job imgJob) queuedAt(t time.Time) imgJob {
+	job.queued = t
+	return job
+}
+
+func (job requestJob) queuedAt(t time.Time) requestJob {
+	job.queued = t
+	return job
+}
+
+//lanes очередь этапа пайплайна с полосами приоритета
+type lanes[T laneJob[T]] struct {
+	lanes  [laneCount]chan T
+	picker *lanePicker
+}
+
+//imgLanes очередь этапа ресайза или сохранения
+type imgLanes = lanes[imgJob]
+
+//requestLanes очередь этапа загрузки
+type requestLanes = lanes[requestJob]
+
+func newLanes[T laneJob[T]](interactiveSize, bulkSize int, picker *lanePicker) *lanes[T] {
+	return &lanes[T]{
+		lanes:  [laneCount]chan T{make(chan T, interactiveSize), make(chan T, bulkSize)},
+		picker: picker,
+	}
+}
+
+//push ставит задачу в полосу ctx, ожидая места до сигнала wait. Без места возвращает errNoSpace
+func (q *lanes[T]) push(ctx context.Context, job T, wait <-chan time.Time, quit <-chan struct{}) error {
+	select {
+	case q.lanes[laneOf(ctx)] <- job.queuedAt(time.Now()):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-wait:
+		return errNoSpace
+	case <-quit:
+		return ErrStopped
+	}
+}
+
+//pop забирает следующую задачу с учётом весов полос. Возвращает false, когда все полосы закрыты и пусты
+//или когда свободный воркер получил сигнал retire
+func (q *lanes[T]) pop(retire <-chan struct{}) (T, bool) {
+	for _, i := range q.picker.order() {
+		select {
+		case job, ok := <-q.lanes[i]:
+			if ok {
+				return job, true
+			}
+		default:
+		}
+	}
+
+	var none T
+	interactive, bulk := q.lanes[laneInteractive], q.lanes[laneBulk]
+	for interactive != nil || bulk != nil {
+		select {
+		case job, ok := <-interactive:
+			if ok {
+				return job, true
+			}
+			interactive = nil
+		case job, ok := <-bulk:
+			if ok {
+				return job, true
+			}
+			bulk = nil
+		case <-retire:
+			return none, false
+		}
+	}
+	return none, false
+}
+
+func (q *lanes[T]) len(lane int) int {
+	return len(q.lanes[lane])
+}
+
+func (q *lanes[T]) depth() int {
+	return len(q.lanes[laneInteractive]) + len(q.lanes[laneBulk])
+}
+
+func (q *lanes[T]) capacity() int {
+	return cap(q.lanes[laneInteractive]) + cap(q.lanes[laneBulk])
+}
+
+func (q *lanes[T]) close() {
+	for _, lane := range q.lanes {
+		close(lane)
+	}
+}
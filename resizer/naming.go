@@ -0,0 +1,158 @@
+package resizer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"staply_img_resizer/config"
+	"staply_img_resizer/storage"
+	"strings"
+	"time"
+
+	"github.com/davidbyttow/govips/pkg/vips"
+)
+
+//Способы именования миниатюр для config.NamingMode
+const (
+	//NamingRandom случайный UUID для каждого изображения
+	NamingRandom = "random"
+	//NamingContent хэш исходного изображения и параметров миниатюр. Уже сохранённые миниатюры не пересоздаются
+	NamingContent = "content"
+)
+
+//checkNamingMode проверяет config.NamingMode. Уже сохранённые миниатюры ищутся по пути из layout,
+//поэтому с content путь не может зависеть от даты сохранения
+func checkNamingMode(layout *storage.Layout) error {
+	switch mode := config.GetString(config.NamingMode); mode {
+	case NamingRandom:
+		return nil
+	case NamingContent:
+		if layout.TimeDependent() {
+			return fmt.Errorf("naming mode '%s' needs a storage layout without the date", mode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown naming mode '%s'", mode)
+	}
+}
+
+func contentNaming() bool {
+	return config.GetString(config.NamingMode) == NamingContent
+}
+
+//newBaseID возвращает общий ID миниатюр изображения в соответствии с config.NamingMode
+func newBaseID(img []byte, variants []Options) (string, error) {
+	if contentNaming() {
+		return contentID(img, variants), nil
+	}
+
+	id, err := genName()
+	if err != nil {
+		return "", fmt.Errorf("can't gen name; error %v", err)
+	}
+	return id, nil
+}
+
+//contentID хэш исходного изображения и нормализованных параметров всех вариантов.
+//Значения кодировщика по умолчанию из конфига тоже учитываются
+func contentID(img []byte, variants []Options) string {
+	h := sha256.New()
+	h.Write(img)
+	fmt.Fprintf(h, "\nq%d c%d", config.GetInt(config.OutputQuality), config.GetInt(config.PNGCompression))
+	for _, opts := range variants {
+		h.Write([]byte("\n" + contentKey(opts)))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:40]
+}
+
+//contentKey параметры варианта для contentID. Поля перечислены явно и в постоянном порядке,
+//поэтому ID не меняется, когда в Options добавляются поля или меняется их порядок
+func contentKey(o Options) string {
+	var accept = make([]string, len(o.Accept))
+	for i, f := range o.Accept {
+		accept[i] = string(f)
+	}
+	return fmt.Sprintf("preset=%s width=%d height=%d mode=%s format=%s quality=%d progressive=%t lossless=%t compression=%d accept=%s tenant=%s original=%s",
+		o.Preset, o.Width, o.Height, o.Mode, o.Format, o.Quality, o.Progressive, o.Lossless, o.Compression,
+		strings.Join(accept, ","), o.Tenant, o.Original)
+}
+
+//fileName имя файла варианта без расширения и имя варианта.
+//Если вариант один и не задан named, имя файла совпадает с baseID.
+//Индекс за последним вариантом - исходное изображение
+func fileName(baseID string, variants []Options, i int, named bool) (string, string) {
+	if i == len(variants) {
+		return baseID + "_" + OriginalVariant, OriginalVariant
+	}
+	if len(variants) < 2 && !named {
+		return baseID, ""
+	}
+	variant := variants[i].variantName()
+	return baseID + "_" + variant, variant
+}
+
+//fileKey путь файла варианта i в хранилище
+func fileKey(layout *storage.Layout, baseID string, variants []Options, i int, named bool, ext string) string {
+	name, _ := fileName(baseID, variants, i, named)
+	var opts Options
+	if i < len(variants) {
+		opts = variants[i]
+	} else {
+		opts = Options{Preset: OriginalVariant, Tenant: variants[0].Tenant}
+	}
+	return layout.Key(storage.Fields{
+		ID:     name,
+		BaseID: baseID,
+		Preset: opts.Preset,
+		Tenant: opts.Tenant,
+		Width:  opts.Width,
+		Height: opts.Height,
+		Ext:    strings.TrimPrefix(ext, "."),
+		Time:   time.Now(),
+	})
+}
+
+//existingFile ищет в хранилище уже созданный файл варианта i, не декодируя исходник типа srcType:
+//проверяются расширения, которые может получить этот вариант, а размеры читаются из заголовка файла.
+//Индекс за последним вариантом - исходное изображение
+func existingFile(ctx context.Context, store storage.Storage, layout *storage.Layout, srcType vips.ImageType, baseID string, variants []Options, i int, withData bool) (imgJob, bool) {
+	var types []vips.ImageType
+	var opts Options
+	if i < len(variants) {
+		opts = variants[i]
+		types = opts.encoderTypes(srcType)
+	} else {
+		types = originalTypes(srcType)
+	}
+
+	for _, t := range types {
+		var job = imgJob{
+			opts:         opts,
+			imgExtension: t.OutputExt(),
+			existing:     true,
+		}
+		file, info, err := store.Get(ctx, fileKey(layout, baseID, variants, i, false, job.imgExtension))
+		if err != nil {
+			continue
+		}
+		defer file.Close()
+
+		job.size = int(info.Size)
+		var header io.Reader = file
+		if withData {
+			if job.img, err = ioutil.ReadAll(file); err != nil {
+				return job, false
+			}
+			header = bytes.NewReader(job.img)
+		}
+		if job.width, job.height, err = headerSize(header, t); err != nil {
+			return job, false
+		}
+		return job, true
+	}
+	return imgJob{}, false
+}
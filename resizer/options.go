@@ -0,0 +1,173 @@
+package resizer
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"staply_img_resizer/config"
+
+	"github.com/davidbyttow/govips/pkg/vips"
+)
+
+//ResizeMode способ вписывания изображения в заданные размеры
+type ResizeMode string
+
+const (
+	//ModeCrop масштабирует по меньшей стороне и обрезает лишнее
+	ModeCrop ResizeMode = "crop"
+	//ModeFit вписывает изображение в размеры с сохранением пропорций
+	ModeFit ResizeMode = "fit"
+	//ModeStretch растягивает изображение до размеров без сохранения пропорций
+	ModeStretch ResizeMode = "stretch"
+	//ModePad вписывает изображение и дополняет поля до заданных размеров
+	ModePad ResizeMode = "pad"
+)
+
+//Options параметры создаваемой миниатюры
+type Options struct {
+	Preset string     `json:"preset,omitempty"`
+	Width  int        `json:"width"`
+	Height int        `json:"height"`
+	Mode   ResizeMode `json:"mode"`
+
+	Format Format `json:"format,omitempty"`
+	//Quality качество для jpeg и webp от 1 до 100. 0 - значение из конфига
+	Quality int `json:"quality,omitempty"`
+	//Progressive прогрессивный jpeg или png с чересстрочной разверткой
+	Progressive bool `json:"progressive,omitempty"`
+	//Lossless сжатие webp без потерь
+	Lossless bool `json:"lossless,omitempty"`
+	//Compression уровень сжатия png от 1 до 9. 0 - значение из конфига
+	Compression int `json:"compression,omitempty"`
+	//Accept форматы, которые принимает клиент, в порядке предпочтения. Используется для auto
+	Accept []Format `json:"-"`
+	//Tenant владелец миниатюры, подставляется в путь файла через {tenant}
+	Tenant string `json:"tenant,omitempty"`
+	//Original сохранить вместе с миниатюрой исходное изображение. Пустое - значение из конфига config.KeepOriginal
+	Original OriginalMode `json:"original,omitempty"`
+}
+
+//tenantRe допустимое имя владельца миниатюры
+var tenantRe = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
+
+//Normalize подставляет значения из пресета и по умолчанию и проверяет параметры на допустимость.
+//Если указана только одна сторона, миниатюра получается квадратной
+func (o *Options) Normalize() error {
+	if err := o.applyPreset(); err != nil {
+		return err
+	}
+	if !tenantRe.MatchString(o.Tenant) {
+		return fmt.Errorf("bad tenant '%s'", o.Tenant)
+	}
+	if o.Original != "" {
+		if err := o.Original.validate(); err != nil {
+			return err
+		}
+	}
+
+	if o.Width == 0 && o.Height == 0 {
+		o.Width = config.GetInt(config.DefaultThumbnailWidth)
+		o.Height = config.GetInt(config.DefaultThumbnailHeight)
+	}
+	if o.Width == 0 {
+		o.Width = o.Height
+	}
+	if o.Height == 0 {
+		o.Height = o.Width
+	}
+	if o.Mode == "" {
+		o.Mode = ResizeMode(config.GetString(config.DefaultResizeMode))
+	}
+
+	switch o.Mode {
+	case ModeCrop, ModeFit, ModeStretch, ModePad:
+	default:
+		return fmt.Errorf("unknown resize mode '%s'", o.Mode)
+	}
+
+	min := config.GetInt(config.MinThumbnailSize)
+	max := config.GetInt(config.MaxThumbnailSize)
+	if o.Width < min || o.Width > max || o.Height < min || o.Height > max {
+		return fmt.Errorf("thumbnail size %dx%d is out of bounds [%d, %d]",
+			o.Width, o.Height, min, max)
+	}
+	return o.validateEncoder()
+}
+
+//NormalizeVariants нормализует параметры всех вариантов одного изображения
+//и проверяет, что их имена не повторяются
+func NormalizeVariants(variants []Options) error {
+	if len(variants) == 0 {
+		return fmt.Errorf("no thumbnail variants requested")
+	}
+	if max := config.GetInt(config.MaxVariants); len(variants) > max {
+		return fmt.Errorf("too many thumbnail variants: %d, max %d", len(variants), max)
+	}
+
+	var names = make(map[string]bool, len(variants))
+	for i := range variants {
+		if err := variants[i].Normalize(); err != nil {
+			return err
+		}
+		name := variants[i].variantName()
+		if name == OriginalVariant {
+			return fmt.Errorf("thumbnail variant name '%s' is reserved", name)
+		}
+		if names[name] {
+			return fmt.Errorf("duplicate thumbnail variant '%s'", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+//variantName имя варианта, добавляемое к ID миниатюры: имя пресета или размеры и способ ресайза
+func (o Options) variantName() string {
+	if o.Preset != "" {
+		return o.Preset
+	}
+	name := fmt.Sprintf("%dx%d_%s", o.Width, o.Height, o.Mode)
+	if o.Format != "" && o.Format != FormatAuto {
+		name += "_" + string(o.Format)
+	}
+	return name
+}
+
+//transform настраивает преобразование vips для исходного изображения
+func (o Options) transform(src *vips.ImageRef) *vips.Transform {
+	t := vips.NewTransform().Image(src)
+
+	switch o.Mode {
+	case ModeFit:
+		scale := math.Min(
+			float64(o.Width)/float64(src.Width()),
+			float64(o.Height)/float64(src.Height()),
+		)
+		t.ResizeStrategy(vips.ResizeStrategyStretch).
+			Resize(
+				fitSide(src.Width(), scale),
+				fitSide(src.Height(), scale),
+			)
+	case ModeStretch:
+		t.ResizeStrategy(vips.ResizeStrategyStretch).
+			Resize(o.Width, o.Height)
+	case ModePad:
+		t.ResizeStrategy(vips.ResizeStrategyEmbed).
+			PadStrategy(vips.ExtendWhite).
+			Resize(o.Width, o.Height)
+	default:
+		t.ResizeStrategy(vips.ResizeStrategyCrop).
+			Resize(o.Width, o.Height)
+	}
+
+	o.applyEncoder(t, src)
+	return t.OutputBytes()
+}
+
+func fitSide(side int, scale float64) int {
+	res := int(math.Round(float64(side) * scale))
+	if res < 1 {
+		return 1
+	}
+	return res
+}
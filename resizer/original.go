@@ -0,0 +1,111 @@
+package resizer
+
+import (
+	"fmt"
+	"path"
+	"staply_img_resizer/config"
+	"strings"
+
+	"github.com/davidbyttow/govips/pkg/vips"
+)
+
+//OriginalMode сохранение исходного изображения вместе с миниатюрами
+type OriginalMode string
+
+const (
+	//OriginalNone исходное изображение не сохраняется
+	OriginalNone OriginalMode = "none"
+	//OriginalSource исходное изображение сохраняется как есть
+	OriginalSource OriginalMode = "original"
+	//OriginalMaster сохраняется копия, уменьшенная до config.OriginalMaxSide по большей стороне
+	OriginalMaster OriginalMode = "master"
+)
+
+//OriginalVariant имя варианта, под которым сохраняется исходное изображение
+const OriginalVariant = "original"
+
+func (m OriginalMode) validate() error {
+	switch m {
+	case OriginalNone, OriginalSource, OriginalMaster:
+		return nil
+	default:
+		return fmt.Errorf("unknown original mode '%s'", m)
+	}
+}
+
+func checkOriginalMode() error {
+	if side := config.GetInt(config.OriginalMaxSide); side < 1 {
+		return fmt.Errorf("bad original max side %d", side)
+	}
+	return OriginalMode(config.GetString(config.KeepOriginal)).validate()
+}
+
+//originalMode как сохранять исходное изображение для набора вариантов.
+//Если варианты просят разное, выбирается исходник как есть, затем мастер-копия.
+//Для вариантов без Original используется config.KeepOriginal
+func originalMode(variants []Options) OriginalMode {
+	var mode = OriginalNone
+	for _, opts := range variants {
+		if opts.Original == "" {
+			opts.Original = OriginalMode(config.GetString(config.KeepOriginal))
+		}
+		switch opts.Original {
+		case OriginalSource:
+			return OriginalSource
+		case OriginalMaster:
+			mode = OriginalMaster
+		}
+	}
+	return mode
+}
+
+//resultCount количество результатов задачи: миниатюры и, если он сохраняется, исходник
+func resultCount(variants []Options) int {
+	if originalMode(variants) != OriginalNone {
+		return len(variants) + 1
+	}
+	return len(variants)
+}
+
+//originalImage готовит исходное изображение к сохранению. Мастер-копия создаётся,
+//только если исходник больше config.OriginalMaxSide, иначе сохраняется сам исходник.
+//Исходник в формате, который vips не умеет сохранять, перекодируется
+func originalImage(img []byte, src *vips.ImageRef, mode OriginalMode) (imgJob, error) {
+	maxSide := config.GetInt(config.OriginalMaxSide)
+	fits := src.Width() <= maxSide && src.Height() <= maxSide
+	if ext := src.Format().OutputExt(); ext != "" && (mode == OriginalSource || fits) {
+		return imgJob{
+			img:          img,
+			size:         len(img),
+			imgExtension: ext,
+			width:        src.Width(),
+			height:       src.Height(),
+		}, nil
+	}
+
+	opts := Options{Width: maxSide, Height: maxSide, Mode: ModeFit}
+	if mode == OriginalSource || fits {
+		opts.Width, opts.Height = src.Width(), src.Height()
+	}
+	return resizeVariant(src, opts)
+}
+
+//originalTypes типы, в которых может быть сохранён исходник типа srcType: сам исходник
+//или мастер-копия, закодированная как миниатюра без явного формата
+func originalTypes(srcType vips.ImageType) []vips.ImageType {
+	types := Options{}.encoderTypes(srcType)
+	if srcType.OutputExt() != "" && srcType != types[0] {
+		types = append([]vips.ImageType{srcType}, types...)
+	}
+	return types
+}
+
+//OriginalBaseID возвращает base_id, если name - путь сохранённого исходного изображения
+func OriginalBaseID(name string) (string, bool) {
+	name = path.Base(name)
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if !strings.HasSuffix(name, "_"+OriginalVariant) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, "_"+OriginalVariant), true
+}
@@ -0,0 +1,147 @@
+package resizer
+
+import (
+	"fmt"
+	"staply_img_resizer/config"
+	"strings"
+	"sync"
+)
+
+//presetsCache пресеты, разобранные из строки конфига src
+var presetsCache struct {
+	sync.Mutex
+	parsed  bool
+	src     string
+	presets map[string]Options
+	err     error
+}
+
+//Presets пресеты из конфига config.Presets. Строка разбирается один раз и повторно только
+//после изменения конфига, поэтому возвращаемый словарь нельзя изменять
+func Presets() (map[string]Options, error) {
+	src := config.GetString(config.Presets)
+	presetsCache.Lock()
+	defer presetsCache.Unlock()
+	if !presetsCache.parsed || presetsCache.src != src {
+		presetsCache.presets, presetsCache.err = parsePresets(src)
+		presetsCache.parsed, presetsCache.src = true, src
+	}
+	return presetsCache.presets, presetsCache.err
+}
+
+//parsePresets разбирает строку вида "avatar=64x64 crop;card=320x200 fit webp q80".
+//Кроме размеров и способа ресайза в пресете можно указать формат, качество qN,
+//уровень сжатия png cN, progressive и lossless
+func parsePresets(s string) (map[string]Options, error) {
+	var presets = make(map[string]Options)
+	for _, def := range strings.Split(s, ";") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		parts := strings.SplitN(def, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			return nil, fmt.Errorf("bad preset definition '%s'", def)
+		}
+
+		opts, err := parsePreset(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad preset '%s': %v", name, err)
+		}
+		presets[name] = opts
+	}
+	return presets, nil
+}
+
+func parsePreset(s string) (Options, error) {
+	var opts Options
+	for _, token := range strings.Fields(s) {
+		var w, h, n int
+		if c, _ := fmt.Sscanf(token, "%dx%d", &w, &h); c == 2 {
+			opts.Width, opts.Height = w, h
+			continue
+		}
+		if c, _ := fmt.Sscanf(token, "q%d", &n); c == 1 {
+			opts.Quality = n
+			continue
+		}
+		if c, _ := fmt.Sscanf(token, "c%d", &n); c == 1 {
+			opts.Compression = n
+			continue
+		}
+
+		switch token {
+		case string(ModeCrop), string(ModeFit), string(ModeStretch), string(ModePad):
+			opts.Mode = ResizeMode(token)
+		case string(FormatAuto), string(FormatJPEG), string(FormatPNG), string(FormatWEBP), string(FormatAVIF):
+			opts.Format = Format(token)
+		case "progressive":
+			opts.Progressive = true
+		case "lossless":
+			opts.Lossless = true
+		default:
+			return opts, fmt.Errorf("unknown token '%s'", token)
+		}
+	}
+
+	if opts.Width == 0 || opts.Height == 0 {
+		return opts, fmt.Errorf("size is missing")
+	}
+	return opts, opts.validateEncoder()
+}
+
+//applyPreset заполняет незаданные параметры из пресета.
+//В строгом режиме параметры, отличные от пресета, запрещены
+func (o *Options) applyPreset() error {
+	strict := config.GetBool(config.StrictPresets)
+	if o.Preset == "" {
+		if strict {
+			return fmt.Errorf("parameter 'preset' is required")
+		}
+		return nil
+	}
+
+	presets, err := Presets()
+	if err != nil {
+		return err
+	}
+	preset, ok := presets[o.Preset]
+	if !ok {
+		return fmt.Errorf("unknown preset '%s'", o.Preset)
+	}
+	if preset.Mode == "" {
+		preset.Mode = ResizeMode(config.GetString(config.DefaultResizeMode))
+	}
+
+	if strict && (o.Width != 0 && o.Width != preset.Width ||
+		o.Height != 0 && o.Height != preset.Height ||
+		o.Mode != "" && o.Mode != preset.Mode ||
+		o.Format != "" && o.Format != FormatAuto && o.Format != preset.Format ||
+		o.Quality != 0 && o.Quality != preset.Quality ||
+		o.Compression != 0 && o.Compression != preset.Compression ||
+		o.Progressive && !preset.Progressive ||
+		o.Lossless && !preset.Lossless) {
+		return fmt.Errorf("only preset parameters are allowed")
+	}
+
+	if o.Width == 0 && o.Height == 0 {
+		o.Width, o.Height = preset.Width, preset.Height
+	}
+	if o.Mode == "" {
+		o.Mode = preset.Mode
+	}
+	if o.Format == "" {
+		o.Format = preset.Format
+	}
+	if o.Quality == 0 {
+		o.Quality = preset.Quality
+	}
+	if o.Compression == 0 {
+		o.Compression = preset.Compression
+	}
+	o.Progressive = o.Progressive || preset.Progressive
+	o.Lossless = o.Lossless || preset.Lossless
+	return nil
+}
@@ -1,12 +1,14 @@
 package resizer
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"path"
 	"staply_img_resizer/config"
+	"staply_img_resizer/storage"
 	"sync"
 	"time"
 
@@ -15,51 +17,200 @@ import (
 )
 
 func init() {
-	client = config.HTTPClient
+	client = config.FetchHTTPClient
 }
 
 var client Client
 
+//Client загружает исходные изображения. Запросы несут контекст задачи
 type Client interface {
-	Get(url string) (*http.Response, error)
-	Head(url string) (*http.Response, error)
+	Do(req *http.Request) (*http.Response, error)
 }
 
+//Resizer создаёт миниатюры. Задачи с ctx прекращаются на следующем этапе пайплайна,
+//как только ctx отменён или истёк config.JobTimeoutSec
 type Resizer interface {
-	FromUrl(url string) error
-	ResizeImg(img []byte) error
+	FromUrl(ctx context.Context, url string, variants []Options) ([]*Result, error)
+	ResizeImg(ctx context.Context, img []byte, variants []Options) ([]*Result, error)
+	//RenderUrl создаёт миниатюру по url и возвращает её вместе с содержимым.
+	//Миниатюра сохраняется под переданным id, а при пустом id не сохраняется
+	RenderUrl(ctx context.Context, url string, opts Options, id string) (*Result, error)
+	//SubmitUrl и SubmitImg ставят асинхронную задачу и сразу возвращают её ID.
+	//Задача не зависит от отмены ctx и ограничена config.AsyncJobTimeoutSec, из ctx берётся только полоса.
+	//Если callbackURL не пустой, по завершении задачи на него отправляется её результат
+	SubmitUrl(ctx context.Context, url string, variants []Options, callbackURL string) (string, error)
+	SubmitImg(ctx context.Context, img []byte, variants []Options, callbackURL string) (string, error)
+	//Job возвращает состояние асинхронной задачи
+	Job(id string) (JobStatus, bool)
+	//Workers возвращает состояние пулов воркеров и последние решения автоскейлера
+	Workers() []PoolStatus
+}
+
+//Result описание созданной миниатюры
+type Result struct {
+	//ID сгенерированное имя файла без расширения
+	ID string `json:"id"`
+	//BaseID общий ID всех вариантов, созданных из одного изображения
+	BaseID string `json:"base_id"`
+	//Path путь файла в хранилище
+	Path string `json:"path,omitempty"`
+	//Variant имя варианта, если из изображения создано несколько миниатюр
+	Variant   string `json:"variant,omitempty"`
+	Extension string `json:"extension"`
+	Size      int    `json:"size"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	//Existing миниатюра уже была в хранилище и не создавалась заново
+	Existing bool `json:"existing,omitempty"`
+	//Data содержимое миниатюры. Заполняется только в RenderUrl
+	Data []byte `json:"-"`
 }
 
 type ImgResizer struct {
-	resizeChan     chan imgJob
-	fileSaveChan   chan imgJob
-	requestImgChan chan requestJob
-	wg             sync.WaitGroup
+	//очереди этапов пайплайна с полосами приоритета
+	resizeChan     *imgLanes
+	fileSaveChan   *imgLanes
+	requestImgChan *requestLanes
+	//wg сборщик миниатюр, остальные группы - воркеры каждого этапа пайплайна
+	wg           sync.WaitGroup
+	requestImgWg sync.WaitGroup
+	resizeWg     sync.WaitGroup
+	fileSaveWg   sync.WaitGroup
+	//pools пулы воркеров этапов, autoscaleWg - их автоскейлер
+	pools       []*workerPool
+	autoscaleWg sync.WaitGroup
+	//quit закрывается при остановке, после неё задачи в очереди не ставятся
+	quit chan struct{}
+	//stopOnce запускает остановку один раз, drained закрывается, когда она завершена
+	stopOnce sync.Once
+	drained  chan struct{}
+	//asyncWg асинхронные задачи вместе с отправкой callback. Их контекст наследует
+	//asyncCtx, который abort отменяет, если остановка не уложилась в отведённое время
+	asyncWg  sync.WaitGroup
+	asyncCtx context.Context
+	abort    context.CancelFunc
+	//enqueueMu не даёт закрыть очереди, пока в них ставятся задачи
+	enqueueMu   sync.RWMutex
+	jobs        *jobStore
+	storage     storage.Storage
+	layout      *storage.Layout
+	sweeperStop chan struct{}
+	//done пропускная способность пайплайна для оценки Retry-After
+	done *rateMeter
 }
 
 type imgJob struct {
-	img          []byte
+	img []byte
+	//variants параметры всех миниатюр, которые нужно создать из img
+	variants []Options
+	//после ресайза задача описывает один вариант
+	opts         Options
+	variant      int
+	baseID       string
 	imgExtension string
-	err          chan error
+	width        int
+	height       int
+	//size размер миниатюры. У найденной в хранилище миниатюры img может быть не загружен
+	size int
+	//existing миниатюра уже есть в хранилище, сохранять её не нужно
+	existing bool
+	render   renderParams
+	tracker  jobTracker
+	//ctx контекст задачи. После его отмены задача не переходит на следующий этап
+	ctx context.Context
+	err chan jobResult
+	//queued когда задача поставлена в очередь текущего этапа
+	queued time.Time
 }
 
 type requestJob struct {
-	url string
-	err chan error
+	url      string
+	variants []Options
+	render   renderParams
+	tracker  jobTracker
+	ctx      context.Context
+	err      chan jobResult
+	queued   time.Time
+}
+
+//renderParams параметры задач RenderUrl и Reprocess
+type renderParams struct {
+	//id имя, под которым сохраняется миниатюра. Если пустое, генерируется новое
+	id string
+	//skipSave не сохранять миниатюру
+	skipSave bool
+	//withData вернуть содержимое миниатюры в результате
+	withData bool
+	//named называть файлы по имени варианта, даже если вариант один
+	named bool
+}
+
+type jobResult struct {
+	res     *Result
+	variant int
+	err     error
 }
 
-//NewImgResizer создаёт resizer с запущенными воркерами и настраивает vips
-func NewImgResizer() *ImgResizer {
+//NewImgResizer создаёт resizer с запущенными воркерами, сохраняющими миниатюры в store, и настраивает vips.
+//Если задана политика хранения, запускается и сборщик хранилища
+func NewImgResizer(store storage.Storage) *ImgResizer {
+	return newImgResizer(store, true)
+}
+
+//NewImgResizerWithoutSweeper создаёт resizer без сборщика хранилища для утилит,
+//которые работают рядом с запущенным сервисом и его сборщиком
+func NewImgResizerWithoutSweeper(store storage.Storage) *ImgResizer {
+	return newImgResizer(store, false)
+}
+
+func newImgResizer(store storage.Storage, sweeper bool) *ImgResizer {
 	resizer := ImgResizer{
-		resizeChan:     make(chan imgJob, config.GetInt(config.ResizeChannelSize)),
-		fileSaveChan:   make(chan imgJob, config.GetInt(config.FileSaveChannelSize)),
-		requestImgChan: make(chan requestJob, config.GetInt(config.RequestImgChannelSize)),
-		wg:             sync.WaitGroup{},
+		quit:        make(chan struct{}),
+		drained:     make(chan struct{}),
+		jobs:        newJobStore(),
+		storage:     store,
+		sweeperStop: make(chan struct{}),
+		done:        &rateMeter{},
+	}
+
+	log.Printf("Resize channel size: %v, bulk %v",
+		config.GetInt(config.ResizeChannelSize), config.GetInt(config.BulkResizeChannelSize))
+	log.Printf("File save channel size: %v, bulk %v",
+		config.GetInt(config.FileSaveChannelSize), config.GetInt(config.BulkFileSaveChannelSize))
+	log.Printf("Request image channel size: %v, bulk %v",
+		config.GetInt(config.RequestImgChannelSize), config.GetInt(config.BulkRequestImgChannelSize))
+
+	if err := checkLanes(); err != nil {
+		log.Fatalf("Bad lanes config: %v", err)
+	}
+	//у каждого этапа свой круг выбора полос
+	resizer.resizeChan = newLanes[imgJob](config.GetInt(config.ResizeChannelSize),
+		config.GetInt(config.BulkResizeChannelSize), pickerFromConfig())
+	resizer.fileSaveChan = newLanes[imgJob](config.GetInt(config.FileSaveChannelSize),
+		config.GetInt(config.BulkFileSaveChannelSize), pickerFromConfig())
+	resizer.requestImgChan = newLanes[requestJob](config.GetInt(config.RequestImgChannelSize),
+		config.GetInt(config.BulkRequestImgChannelSize), pickerFromConfig())
+
+	layout, err := storage.LayoutFromConfig()
+	if err != nil {
+		log.Fatalf("Bad storage layout config: %v", err)
+	}
+	resizer.layout = layout
+	if err := checkNamingMode(layout); err != nil {
+		log.Fatalf("Bad naming config: %v", err)
+	}
+	if err := checkOriginalMode(); err != nil {
+		log.Fatalf("Bad original config: %v", err)
+	}
+	if err := checkRetention(); err != nil {
+		log.Fatalf("Bad retention config: %v", err)
 	}
 
-	log.Printf("Resize channel size: %v", config.GetInt(config.ResizeChannelSize))
-	log.Printf("File save channel size: %v", config.GetInt(config.FileSaveChannelSize))
-	log.Printf("Request image channel size: %v", config.GetInt(config.RequestImgChannelSize))
+	presets, err := Presets()
+	if err != nil {
+		log.Fatalf("Bad presets config: %v", err)
+	}
+	log.Printf("The count of presets: %v", len(presets))
 
 	vips.Startup(
 		&vips.Config{
@@ -72,153 +223,590 @@ func NewImgResizer() *ImgResizer {
 		},
 	)
 
-	startResizeWorkerPool(&resizer.wg, resizer.resizeChan, resizer.fileSaveChan)
-	startFileSaveWorkerPool(&resizer.wg, resizer.fileSaveChan)
-	startRequestImgWorkerPool(&resizer.wg, resizer.requestImgChan, resizer.resizeChan)
+	resizer.pools = []*workerPool{
+		newRequestImgWorkerPool(&resizer.requestImgWg, resizer.requestImgChan, resizer.resizeChan),
+		newResizeWorkerPool(&resizer.resizeWg, resizer.resizeChan, resizer.fileSaveChan, resizer.storage, resizer.layout),
+		newFileSaveWorkerPool(&resizer.fileSaveWg, resizer.fileSaveChan, resizer.storage, resizer.layout),
+	}
+	if err := checkAutoscale(resizer.pools); err != nil {
+		log.Fatalf("Bad autoscale config: %v", err)
+	}
+	startWorkerPools(resizer.pools)
+	startAutoscaler(&resizer.autoscaleWg, resizer.pools, resizer.quit)
+	if sweeper {
+		startSweeper(&resizer.wg, resizer.storage, resizer.layout, resizer.sweeperStop)
+	}
+	resizer.asyncCtx, resizer.abort = context.WithCancel(context.Background())
 	return &resizer
 }
 
-func (r *ImgResizer) FromUrl(url string) error {
-	var errChan = make(chan error, 1)
-	r.requestImgChan <- requestJob{
-		url: url,
+func (r *ImgResizer) FromUrl(ctx context.Context, url string, variants []Options) ([]*Result, error) {
+	if err := NormalizeVariants(variants); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, jobTimeout())
+	defer cancel()
+	var errChan = make(chan jobResult, resultCount(variants))
+	if err := r.enqueueRequest(ctx, requestJob{
+		url:      url,
+		variants: variants,
+		ctx:      ctx,
+		err:      errChan,
+	}, enqueueWait()); err != nil {
+		return nil, jobError(err, "request")
+	}
+	return r.finished(waitResults(ctx, errChan, resultCount(variants), "request"))
+}
+
+func (r *ImgResizer) ResizeImg(ctx context.Context, img []byte, variants []Options) ([]*Result, error) {
+	if err := NormalizeVariants(variants); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, jobTimeout())
+	defer cancel()
+	var errChan = make(chan jobResult, resultCount(variants))
+	if err := r.enqueueResize(ctx, imgJob{
+		img:      img,
+		variants: variants,
+		ctx:      ctx,
+		err:      errChan,
+	}, enqueueWait()); err != nil {
+		return nil, jobError(err, "resize")
+	}
+	return r.finished(waitResults(ctx, errChan, resultCount(variants), "resize"))
+}
+
+func (r *ImgResizer) RenderUrl(ctx context.Context, url string, opts Options, id string) (*Result, error) {
+	var variants = []Options{opts}
+	if err := NormalizeVariants(variants); err != nil {
+		return nil, err
+	}
+	//исходник для RenderUrl не сохраняется
+	variants[0].Original = OriginalNone
+
+	ctx, cancel := context.WithTimeout(ctx, jobTimeout())
+	defer cancel()
+	var errChan = make(chan jobResult, 1)
+	if err := r.enqueueRequest(ctx, requestJob{
+		url:      url,
+		variants: variants,
+		render: renderParams{
+			id:       id,
+			skipSave: id == "",
+			withData: true,
+		},
+		ctx: ctx,
 		err: errChan,
+	}, enqueueWait()); err != nil {
+		return nil, jobError(err, "render")
 	}
-	select {
-	case err := <-errChan:
-		close(errChan)
-		return err
-	case <-time.After(time.Second * config.GetDuration(
-		config.JobTimeoutSec)):
-		close(errChan)
-		return fmt.Errorf("Timout for request job")
+	res, err := r.finished(waitResults(ctx, errChan, 1, "render"))
+	if err != nil {
+		return nil, err
 	}
+	return res[0], nil
 }
 
-func (r *ImgResizer) ResizeImg(img []byte) error {
-	var errChan = make(chan error, 1)
-	r.resizeChan <- imgJob{
-		img: img,
+//Reprocess заново создаёт миниатюры сохранённого исходника под его baseID.
+//Файлы всегда называются {baseID}_{variant}, уже сохранённые миниатюры перезаписываются,
+//а сам исходник не сохраняется повторно
+func (r *ImgResizer) Reprocess(ctx context.Context, img []byte, baseID string, variants []Options) ([]*Result, error) {
+	if err := NormalizeVariants(variants); err != nil {
+		return nil, err
+	}
+	for i := range variants {
+		variants[i].Original = OriginalNone
+	}
+
+	//перегенерация - внутренняя задача и ждёт места в очереди
+	ctx, cancel := context.WithTimeout(WithQueueWait(ctx), jobTimeout())
+	defer cancel()
+	var errChan = make(chan jobResult, len(variants))
+	if err := r.enqueueResize(ctx, imgJob{
+		img:      img,
+		variants: variants,
+		render: renderParams{
+			id:    baseID,
+			named: true,
+		},
+		ctx: ctx,
 		err: errChan,
+	}, enqueueWait()); err != nil {
+		return nil, jobError(err, "reprocess")
 	}
+	return r.finished(waitResults(ctx, errChan, len(variants), "reprocess"))
+}
+
+//enqueueRequest ставит задачу загрузки в очередь. Если очередь не освободилась
+//за wait, возвращает *QueueFullError. Задачи с WithQueueWait ждут, пока не отменён ctx
+func (r *ImgResizer) enqueueRequest(ctx context.Context, job requestJob, wait time.Duration) error {
+	r.enqueueMu.RLock()
+	defer r.enqueueMu.RUnlock()
+	timeout, stop := queueTimeout(ctx, wait)
+	defer stop()
 	select {
-	case err := <-errChan:
-		close(errChan)
-		return err
-	case <-time.After(time.Second * config.GetDuration(
-		config.JobTimeoutSec)):
-		close(errChan)
-		return fmt.Errorf("Timout for resize job")
+	case <-r.quit:
+		return ErrStopped
+	default:
+	}
+	err := r.requestImgChan.push(ctx, job, timeout, r.quit)
+	if err == errNoSpace {
+		return r.queueFull("request", r.requestImgChan.len(laneOf(ctx)))
 	}
+	return err
 }
 
-//Stop останавливает все воркеры и ждёт их завершения
-func (r *ImgResizer) Stop() {
-	close(r.resizeChan)
-	close(r.requestImgChan)
-	close(r.fileSaveChan)
-	r.wg.Wait()
+//enqueueResize ставит задачу ресайза в очередь. Если очередь не освободилась
+//за wait, возвращает *QueueFullError. Задачи с WithQueueWait ждут, пока не отменён ctx
+func (r *ImgResizer) enqueueResize(ctx context.Context, job imgJob, wait time.Duration) error {
+	r.enqueueMu.RLock()
+	defer r.enqueueMu.RUnlock()
+	timeout, stop := queueTimeout(ctx, wait)
+	defer stop()
+	select {
+	case <-r.quit:
+		return ErrStopped
+	default:
+	}
+	err := r.resizeChan.push(ctx, job, timeout, r.quit)
+	if err == errNoSpace {
+		return r.queueFull("resize", r.resizeChan.len(laneOf(ctx)))
+	}
+	return err
 }
 
-func resizeWorker(wg *sync.WaitGroup, in <-chan imgJob, out chan<- imgJob) {
-	defer wg.Done()
-	var err error
-	var imgType vips.ImageType
-	for job := range in {
+func (r *ImgResizer) queueFull(queue string, depth int) *QueueFullError {
+	return &QueueFullError{
+		Queue:      queue,
+		Depth:      depth,
+		RetryAfter: retryAfter(depth, r.done.rate(time.Now())),
+	}
+}
 
-		if len(job.img) == 0 {
-			writeErr(job.err, fmt.Errorf("image is missing"))
-			continue
-		}
+//finished учитывает успешно завершённую задачу в пропускной способности.
+//Ошибки и таймауты не считаются, иначе при сбоях пайплайна Retry-After занижается
+func (r *ImgResizer) finished(results []*Result, err error) ([]*Result, error) {
+	if err == nil {
+		r.done.add(time.Now())
+	}
+	return results, err
+}
 
-		job.img, imgType, err = vips.NewTransform().
-			LoadBuffer(job.img).
-			ResizeStrategy(vips.ResizeStrategyCrop).
-			Resize(100, 100).
-			OutputBytes().
-			Apply()
+func (r *ImgResizer) SubmitUrl(ctx context.Context, url string, variants []Options, callbackURL string) (string, error) {
+	if err := NormalizeVariants(variants); err != nil {
+		return "", err
+	}
 
-		if err != nil {
-			writeErr(job.err, fmt.Errorf("resize error: %v", err))
-			continue
-		}
+	return r.submit(PriorityFrom(ctx), resultCount(variants), "request", callbackURL, func(ctx context.Context, tracker jobTracker, errChan chan jobResult) error {
+		return r.enqueueRequest(ctx, requestJob{
+			url:      url,
+			variants: variants,
+			tracker:  tracker,
+			ctx:      ctx,
+			err:      errChan,
+		}, enqueueWait())
+	})
+}
 
-		job.imgExtension = imgType.OutputExt()
-		out <- job
+func (r *ImgResizer) SubmitImg(ctx context.Context, img []byte, variants []Options, callbackURL string) (string, error) {
+	if err := NormalizeVariants(variants); err != nil {
+		return "", err
 	}
+
+	return r.submit(PriorityFrom(ctx), resultCount(variants), "resize", callbackURL, func(ctx context.Context, tracker jobTracker, errChan chan jobResult) error {
+		return r.enqueueResize(ctx, imgJob{
+			img:      img,
+			variants: variants,
+			tracker:  tracker,
+			ctx:      ctx,
+			err:      errChan,
+		}, enqueueWait())
+	})
 }
 
-func fileSaveWorker(wg *sync.WaitGroup, in <-chan imgJob) {
-	defer wg.Done()
+func (r *ImgResizer) Job(id string) (JobStatus, bool) {
+	return r.jobs.get(id)
+}
 
-	for job := range in {
-		name, err := genName()
-		if err != nil {
-			writeErr(job.err, fmt.Errorf("can't gen name; error %v", err))
-			continue
+func (r *ImgResizer) Workers() []PoolStatus {
+	var res = make([]PoolStatus, 0, len(r.pools))
+	for _, p := range r.pools {
+		res = append(res, p.status())
+	}
+	return res
+}
+
+//submit создаёт асинхронную задачу и сразу ставит её в очередь через enqueue, ожидая места
+//не дольше enqueueWait, как и синхронные задачи. Если очередь заполнена, задача не создаётся
+//и возвращается *QueueFullError. Результат ждётся в фоне не дольше config.AsyncJobTimeoutSec
+//и отправляется на callbackURL
+func (r *ImgResizer) submit(priority Priority, count int, jobName string, callbackURL string, enqueue func(context.Context, jobTracker, chan jobResult) error) (string, error) {
+	if !r.trackAsync() {
+		return "", ErrStopped
+	}
+	id, err := r.jobs.create()
+	if err != nil {
+		r.asyncWg.Done()
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(WithPriority(r.asyncCtx, priority),
+		time.Second*config.GetDuration(config.AsyncJobTimeoutSec))
+	var errChan = make(chan jobResult, count)
+	if err = enqueue(ctx, jobTracker{store: r.jobs, id: id}, errChan); err != nil {
+		cancel()
+		r.jobs.remove(id)
+		r.asyncWg.Done()
+		if _, ok := err.(*QueueFullError); ok || err == ErrStopped {
+			return "", err
 		}
-		err = ioutil.WriteFile(
-			path.Join(
-				config.GetString(config.FileSaveDir),
-				name+job.imgExtension),
-			job.img,
-			0644)
-		if err != nil {
-			writeErr(job.err, err)
-			continue
+		return "", jobError(err, jobName)
+	}
+
+	go func() {
+		defer r.asyncWg.Done()
+		defer cancel()
+		results, err := r.finished(waitResults(ctx, errChan, count, jobName))
+		job := r.jobs.finish(id, results, err)
+		if callbackURL != "" {
+			sendCallback(r.asyncCtx, callbackURL, job)
 		}
-		writeErr(job.err, nil)
+	}()
+	return id, nil
+}
+
+//trackAsync учитывает новую асинхронную задачу в asyncWg, если resizer ещё не останавливается
+func (r *ImgResizer) trackAsync() bool {
+	r.enqueueMu.RLock()
+	defer r.enqueueMu.RUnlock()
+	select {
+	case <-r.quit:
+		return false
+	default:
 	}
+	r.asyncWg.Add(1)
+	return true
 }
 
-func requestImgWorker(wg *sync.WaitGroup, in <-chan requestJob, out chan<- imgJob) {
-	defer wg.Done()
+func jobTimeout() time.Duration {
+	return time.Second * config.GetDuration(config.JobTimeoutSec)
+}
 
-	for job := range in {
+//waitResults ждёт результаты по всем вариантам задачи или первую ошибку, пока не отменён ctx
+func waitResults(ctx context.Context, errChan chan jobResult, count int, jobName string) ([]*Result, error) {
+	var results = make([]*Result, count)
+
+	for received := 0; received < count; received++ {
+		select {
+		case jr := <-errChan:
+			if jr.err != nil {
+				return nil, jr.err
+			}
+			results[jr.variant] = jr.res
+		case <-ctx.Done():
+			return nil, jobError(ctx.Err(), jobName)
+		}
+	}
+	return results, nil
+}
 
-		resp, err := client.Head(job.url)
-		if err != nil {
+//jobError ошибка задачи, прерванной отменой контекста
+func jobError(err error, jobName string) error {
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("Timout for %s job", jobName)
+	}
+	if err == context.Canceled {
+		return fmt.Errorf("The %s job is canceled", jobName)
+	}
+	return err
+}
+
+//ErrStopped задача не принята, потому что resizer останавливается
+var ErrStopped = fmt.Errorf("The resizer is stopped")
+
+//Stop останавливает все воркеры и сборщик миниатюр и ждёт их завершения
+func (r *ImgResizer) Stop() {
+	r.Shutdown(context.Background())
+}
+
+//Shutdown перестаёт принимать задачи и по очереди закрывает этапы пайплайна: загрузку, ресайз
+//и сохранение, дожидаясь, пока каждый этап обработает уже принятые задачи, а затем ждёт
+//отправки callback асинхронных задач. Повторные вызовы ждут ту же остановку.
+//Если ctx отменён раньше, незавершённые асинхронные задачи отменяются, их неотправленные callback
+//пишутся в dead letter, и возвращается ошибка ctx, не дожидаясь воркеров
+func (r *ImgResizer) Shutdown(ctx context.Context) error {
+	r.stopOnce.Do(func() {
+		close(r.quit)
+		close(r.sweeperStop)
+		go r.drain()
+	})
+
+	select {
+	case <-r.drained:
+		return nil
+	case <-ctx.Done():
+		r.abort()
+		r.asyncWg.Wait()
+		return ctx.Err()
+	}
+}
+
+//drain закрывает этапы пайплайна по порядку и закрывает drained, когда всё завершено
+func (r *ImgResizer) drain() {
+	//после Lock новых отправок в очереди не будет, и их можно закрыть
+	r.enqueueMu.Lock()
+	defer r.enqueueMu.Unlock()
+
+	//автоскейлер остановлен quit и больше не запускает воркеров
+	r.autoscaleWg.Wait()
+	r.requestImgChan.close()
+	r.requestImgWg.Wait()
+	r.resizeChan.close()
+	r.resizeWg.Wait()
+	r.fileSaveChan.close()
+	r.fileSaveWg.Wait()
+	r.wg.Wait()
+	r.asyncWg.Wait()
+	close(r.drained)
+}
+
+func resizeWorker(p *workerPool, in *imgLanes, out *imgLanes, store storage.Storage, layout *storage.Layout) {
+	defer p.wg.Done()
+	for job, ok := in.pop(p.retire); ok; job, ok = in.pop(p.retire) {
+		resizeImg(job, out, store, layout)
+		p.observe(job.queued)
+	}
+}
+
+//resizeImg создаёт все варианты задачи и передаёт их на сохранение
+func resizeImg(job imgJob, out *imgLanes, store storage.Storage, layout *storage.Layout) {
+	if err := job.ctx.Err(); err != nil {
+		writeErr(job.err, err)
+		return
+	}
+	job.tracker.set(JobResizing)
+
+	if len(job.img) == 0 {
+		writeErr(job.err, fmt.Errorf("image is missing"))
+		return
+	}
+
+	baseID := job.render.id
+	if baseID == "" {
+		var err error
+		if baseID, err = newBaseID(job.img, job.variants); err != nil {
 			writeErr(job.err, err)
-			continue
+			return
 		}
+	}
 
-		if resp.ContentLength > config.GetInt64(config.MaxImageSizeByte) {
-			writeErr(job.err, fmt.Errorf("Image size is too large"))
-			continue
+	//уже сохранённые файлы ищутся до декодирования, и если есть все, исходник не декодируется
+	var existing = make(map[int]imgJob)
+	if job.render.id == "" && contentNaming() {
+		srcType := vips.DetermineImageType(job.img)
+		for i := 0; i < resultCount(job.variants); i++ {
+			if file, ok := existingFile(job.ctx, store, layout, srcType, baseID, job.variants, i, job.render.withData); ok {
+				existing[i] = file
+			}
 		}
+	}
+
+	//исходное изображение декодируется один раз для всех вариантов
+	var src *vips.ImageRef
+	var err error
+	if len(existing) < resultCount(job.variants) {
+		if src, err = vips.NewImageFromBuffer(job.img); err != nil {
+			writeErr(job.err, fmt.Errorf("resize error: %v", err))
+			return
+		}
+		defer src.Close()
+	}
 
-		resp, err = client.Get(job.url)
+	for i, opts := range job.variants {
+		//ресайз каждого варианта дорогой, поэтому отмена проверяется перед каждым
+		if err = job.ctx.Err(); err != nil {
+			writeErr(job.err, err)
+			break
+		}
+		variant, found := existing[i]
+		if !found {
+			if variant, err = resizeVariant(src, opts); err != nil {
+				writeErr(job.err, err)
+				break
+			}
+		}
+		variant.variants = job.variants
+		variant.variant = i
+		variant.baseID = baseID
+		variant.render = job.render
+		variant.tracker = job.tracker
+		variant.ctx = job.ctx
+		variant.err = job.err
+		if err = sendImg(job.ctx, out, variant); err != nil {
+			break
+		}
+	}
+	if err == nil && originalMode(job.variants) != OriginalNone && job.ctx.Err() == nil {
+		original, found := existing[len(job.variants)]
+		if !found {
+			original, err = originalImage(job.img, src, originalMode(job.variants))
+		}
 		if err != nil {
 			writeErr(job.err, err)
-			continue
+		} else {
+			original.variants = job.variants
+			original.variant = len(job.variants)
+			original.baseID = baseID
+			original.tracker = job.tracker
+			original.ctx = job.ctx
+			original.err = job.err
+			sendImg(job.ctx, out, original)
 		}
+	}
+}
 
-		if resp.StatusCode/100 != 2 {
-			writeErr(job.err,
-				fmt.Errorf("failed to get %s: status %d",
-					job.url,
-					resp.StatusCode),
-			)
-			continue
-		}
+func resizeVariant(src *vips.ImageRef, opts Options) (imgJob, error) {
+	var job = imgJob{
+		opts: opts,
+	}
 
-		img := imgJob{
-			err: job.err,
-		}
-		img.img, err = ioutil.ReadAll(resp.Body)
+	img, imgType, err := opts.transform(src).Apply()
+	if err != nil {
+		return job, fmt.Errorf("resize error: %v", err)
+	}
 
-		if int64(len(img.img)) > config.GetInt64(config.MaxImageSizeByte) {
-			writeErr(job.err, fmt.Errorf("Image size is too large."))
-			continue
-		}
+	job.img = img
+	job.size = len(img)
+	job.imgExtension = imgType.OutputExt()
+	job.width, job.height, err = imgSize(img)
+	if err != nil {
+		return job, fmt.Errorf("resize error: %v", err)
+	}
+	return job, nil
+}
 
+func fileSaveWorker(p *workerPool, in *imgLanes, store storage.Storage, layout *storage.Layout) {
+	defer p.wg.Done()
+	for job, ok := in.pop(p.retire); ok; job, ok = in.pop(p.retire) {
+		saveImg(job, store, layout)
+		p.observe(job.queued)
+	}
+}
+
+//saveImg сохраняет вариант в хранилище и отдаёт его результат
+func saveImg(job imgJob, store storage.Storage, layout *storage.Layout) {
+	if err := job.ctx.Err(); err != nil {
+		writeErr(job.err, err)
+		return
+	}
+	job.tracker.set(JobSaving)
+	name, variant := fileName(job.baseID, job.variants, job.variant, job.render.named)
+	key := fileKey(layout, job.baseID, job.variants, job.variant, job.render.named, job.imgExtension)
+
+	if !job.render.skipSave && !job.existing {
+		err := store.Put(job.ctx, key, job.img)
 		if err != nil {
 			writeErr(job.err, err)
-			continue
+			return
 		}
-		out <- img
-		resp.Body.Close()
 	}
+
+	var res = &Result{
+		ID:        name,
+		BaseID:    job.baseID,
+		Path:      key,
+		Variant:   variant,
+		Extension: job.imgExtension,
+		Size:      job.size,
+		Width:     job.width,
+		Height:    job.height,
+		Existing:  job.existing,
+	}
+	if job.render.withData {
+		res.Data = job.img
+	}
+	writeResult(job.err, job.variant, res)
+}
+
+func requestImgWorker(p *workerPool, in *requestLanes, out *imgLanes) {
+	defer p.wg.Done()
+	for job, ok := in.pop(p.retire); ok; job, ok = in.pop(p.retire) {
+		requestImg(job, out)
+		p.observe(job.queued)
+	}
+}
+
+//requestImg загружает исходник и передаёт его на ресайз
+func requestImg(job requestJob, out *imgLanes) {
+	if err := job.ctx.Err(); err != nil {
+		writeErr(job.err, err)
+		return
+	}
+	job.tracker.set(JobFetching)
+
+	img, err := fetchImg(job.ctx, job.url)
+	if err != nil {
+		writeErr(job.err, err)
+		return
+	}
+
+	sendImg(job.ctx, out, imgJob{
+		img:      img,
+		variants: job.variants,
+		render:   job.render,
+		tracker:  job.tracker,
+		ctx:      job.ctx,
+		err:      job.err,
+	})
+}
+
+//fetchImg загружает изображение по url. Запросы прерываются при отмене ctx
+func fetchImg(ctx context.Context, url string) ([]byte, error) {
+	resp, err := doRequest(ctx, http.MethodHead, url)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.ContentLength > config.GetInt64(config.MaxImageSizeByte) {
+		return nil, fmt.Errorf("Image size is too large")
+	}
+
+	resp, err = doRequest(ctx, http.MethodGet, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("failed to get %s: status %d",
+			url,
+			resp.StatusCode)
+	}
+
+	img, err := ioutil.ReadAll(io.LimitReader(resp.Body, config.GetInt64(config.MaxImageSizeByte)+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(img)) > config.GetInt64(config.MaxImageSizeByte) {
+		return nil, fmt.Errorf("Image size is too large.")
+	}
+	return img, nil
+}
+
+func doRequest(ctx context.Context, method string, url string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req.WithContext(ctx))
+}
+
+//sendImg передаёт задачу в её полосу следующего этапа, пока не отменён ctx
+func sendImg(ctx context.Context, out *imgLanes, job imgJob) error {
+	return out.push(ctx, job, nil, nil)
 }
 
 func genName() (string, error) {
@@ -235,41 +823,60 @@ func genName() (string, error) {
 	return res, err
 }
 
-func writeErr(errChan chan<- error, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("Panic: error channel closed. panic value: %v", r)
-		}
-	}()
-	errChan <- err
+//imgSize возвращает ширину и высоту закодированного изображения
+func imgSize(img []byte) (int, int, error) {
+	ref, err := vips.NewImageFromBuffer(img)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer ref.Close()
+	return ref.Width(), ref.Height(), nil
 }
 
-func startResizeWorkerPool(wg *sync.WaitGroup, in <-chan imgJob, out chan<- imgJob) {
-	for i := 0; i < config.GetInt(config.ResizeWorkerCount); i++ {
-		go resizeWorker(wg, in, out)
-		wg.Add(1)
-	}
-	log.Printf("The count of running resize workers: %v",
-		config.GetInt(config.ResizeWorkerCount),
-	)
+func writeErr(errChan chan<- jobResult, err error) {
+	writeJobResult(errChan, jobResult{err: err})
 }
 
-func startFileSaveWorkerPool(wg *sync.WaitGroup, in <-chan imgJob) {
-	for i := 0; i < config.GetInt(config.FileSaveWorkerCount); i++ {
-		go fileSaveWorker(wg, in)
-		wg.Add(1)
+func writeResult(errChan chan<- jobResult, variant int, res *Result) {
+	writeJobResult(errChan, jobResult{res: res, variant: variant})
+}
+
+//writeJobResult отправляет результат ожидающему задачу. Канал не закрывается и вмещает
+//результаты всех вариантов, поэтому отправка не блокирует воркер, даже если задачу уже не ждут
+func writeJobResult(errChan chan<- jobResult, jr jobResult) {
+	select {
+	case errChan <- jr:
+	default:
+		log.Printf("Job result is dropped: result channel is full")
 	}
-	log.Printf("The count of running file save workers: %v",
-		config.GetInt(config.FileSaveWorkerCount),
-	)
 }
 
-func startRequestImgWorkerPool(wg *sync.WaitGroup, in <-chan requestJob, out chan<- imgJob) {
-	for i := 0; i < config.GetInt(config.RequestImgWorkerCount); i++ {
-		go requestImgWorker(wg, in, out)
-		wg.Add(1)
+func newResizeWorkerPool(wg *sync.WaitGroup, in *imgLanes, out *imgLanes, store storage.Storage, layout *storage.Layout) *workerPool {
+	return newWorkerPool("resize", wg, in, config.ResizeWorkerCount, config.ResizeWorkerMin, config.ResizeWorkerMax, config.ResizeTargetLatencyMs,
+		func(p *workerPool) {
+			resizeWorker(p, in, out, store, layout)
+		})
+}
+
+func newFileSaveWorkerPool(wg *sync.WaitGroup, in *imgLanes, store storage.Storage, layout *storage.Layout) *workerPool {
+	return newWorkerPool("file save", wg, in, config.FileSaveWorkerCount, config.FileSaveWorkerMin, config.FileSaveWorkerMax, config.FileSaveTargetLatencyMs,
+		func(p *workerPool) {
+			fileSaveWorker(p, in, store, layout)
+		})
+}
+
+func newRequestImgWorkerPool(wg *sync.WaitGroup, in *requestLanes, out *imgLanes) *workerPool {
+	return newWorkerPool("request img", wg, in, config.RequestImgWorkerCount, config.RequestImgWorkerMin, config.RequestImgWorkerMax, config.RequestImgTargetLatencyMs,
+		func(p *workerPool) {
+			requestImgWorker(p, in, out)
+		})
+}
+
+//startWorkerPools запускает воркеров всех этапов. Начальное число задаётся *WorkerCount,
+//дальше его меняет автоскейлер
+func startWorkerPools(pools []*workerPool) {
+	for _, p := range pools {
+		p.start()
+		log.Printf("The count of running %s workers: %v, min %v, max %v", p.stage, p.status().Workers, p.min, p.max)
 	}
-	log.Printf("The count of running request img workers: %v",
-		config.GetInt(config.RequestImgWorkerCount),
-	)
 }
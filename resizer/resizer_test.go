@@ -2,55 +2,708 @@ package resizer
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"reflect"
 	"staply_img_resizer/config"
+	"staply_img_resizer/storage"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/davidbyttow/govips/pkg/vips"
 )
 
 type clientMockGetImage struct {
 }
 
-func (c *clientMockGetImage) Get(str string) (*http.Response, error) {
-	inputBuf, err := ioutil.ReadFile(str)
+func (c *clientMockGetImage) Do(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	inputBuf, err := ioutil.ReadFile(req.URL.String())
 	if err != nil {
 		return nil, err
 	}
 	resp := &http.Response{
-		StatusCode: 200,
+		StatusCode:    200,
+		ContentLength: int64(len(inputBuf)),
 		Body: ioutil.NopCloser(
 			bytes.NewReader(inputBuf)),
 	}
+	if req.Method == http.MethodHead {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	}
 	return resp, nil
 }
 
-func (c *clientMockGetImage) Head(str string) (*http.Response, error) {
-	inputBuf, err := ioutil.ReadFile(str)
+func TestResize(t *testing.T) {
+	// decoder wants []byte, so read the whole file into a buffer
+	inputBuf, err := ioutil.ReadFile("test_data/test_image.jpg")
 	if err != nil {
-		return nil, err
+		t.Fatalf("failed to read input file, %s\n", err)
 	}
-	resp := &http.Response{
-		StatusCode:    200,
-		ContentLength: int64(len(inputBuf)),
+	store := storage.NewMemory()
+	r := NewImgResizer(store)
+	defer r.Stop()
+
+	testCases := []struct {
+		Opts              Options
+		ExpectedWidth     int
+		ExpectedHeight    int
+		ExpectedExtension string
+	}{
+		{
+			Opts:              Options{},
+			ExpectedWidth:     100,
+			ExpectedHeight:    100,
+			ExpectedExtension: ".jpeg",
+		},
+		{
+			Opts:              Options{Format: FormatPNG, Compression: 9},
+			ExpectedWidth:     100,
+			ExpectedHeight:    100,
+			ExpectedExtension: ".png",
+		},
+		{
+			Opts:              Options{Format: FormatAuto, Accept: []Format{FormatAVIF, FormatWEBP}},
+			ExpectedWidth:     100,
+			ExpectedHeight:    100,
+			ExpectedExtension: ".webp",
+		},
+		{
+			Opts:              Options{Format: FormatAuto},
+			ExpectedWidth:     100,
+			ExpectedHeight:    100,
+			ExpectedExtension: ".jpeg",
+		},
+		{
+			Opts:              Options{Format: FormatWEBP, Quality: 80},
+			ExpectedWidth:     100,
+			ExpectedHeight:    100,
+			ExpectedExtension: ".webp",
+		},
+		{
+			Opts:           Options{Width: 200, Height: 100, Mode: ModeCrop},
+			ExpectedWidth:  200,
+			ExpectedHeight: 100,
+		},
+		{
+			Opts:           Options{Width: 100, Height: 100, Mode: ModeFit},
+			ExpectedWidth:  100,
+			ExpectedHeight: 56,
+		},
+		{
+			Opts:           Options{Width: 100, Height: 100, Mode: ModePad},
+			ExpectedWidth:  100,
+			ExpectedHeight: 100,
+		},
+		{
+			Opts:           Options{Width: 50, Height: 150, Mode: ModeStretch},
+			ExpectedWidth:  50,
+			ExpectedHeight: 150,
+		},
+	}
+
+	for _, tCase := range testCases {
+		results, err := r.ResizeImg(context.Background(), inputBuf, []Options{tCase.Opts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := results[0]
+
+		if res.Width != tCase.ExpectedWidth || res.Height != tCase.ExpectedHeight {
+			t.Errorf("Bad thumbnail size for '%+v'. Expected '%vx%v', got '%vx%v'",
+				tCase.Opts, tCase.ExpectedWidth, tCase.ExpectedHeight, res.Width, res.Height)
+		}
+
+		if tCase.ExpectedExtension != "" && res.Extension != tCase.ExpectedExtension {
+			t.Errorf("Bad thumbnail extension for '%+v'. Expected '%v', got '%v'",
+				tCase.Opts, tCase.ExpectedExtension, res.Extension)
+		}
+
+		info, err := store.Stat(context.Background(), res.ID+res.Extension)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Size != int64(res.Size) {
+			t.Errorf("Bad thumbnail byte size. Expected '%v', got '%v'", info.Size, res.Size)
+		}
+	}
+
+	if _, err := r.ResizeImg(context.Background(), inputBuf, []Options{{Width: 100000}}); err == nil {
+		t.Errorf("Expected error for too large thumbnail")
 	}
-	return resp, nil
 }
 
-func TestResize(t *testing.T) {
+func TestContentNaming(t *testing.T) {
+	config.Set(config.NamingMode, NamingContent)
+	defer config.Set(config.NamingMode, NamingRandom)
+
+	inputBuf, err := ioutil.ReadFile("test_data/test_image.jpg")
+	if err != nil {
+		t.Fatalf("failed to read input file, %s\n", err)
+	}
+	store := storage.NewMemory()
+	r := NewImgResizer(store)
+	defer r.Stop()
+
+	first, err := r.ResizeImg(context.Background(), inputBuf, []Options{{Width: 64}, {Width: 128}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.ResizeImg(context.Background(), inputBuf, []Options{{Width: 64}, {Width: 128}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range first {
+		if first[i].Existing || !second[i].Existing {
+			t.Errorf("Bad existing flags. Expected 'false' and 'true', got '%v' and '%v'", first[i].Existing, second[i].Existing)
+		}
+		if !reflect.DeepEqual(*second[i], Result{
+			ID:        first[i].ID,
+			BaseID:    first[i].BaseID,
+			Path:      first[i].Path,
+			Variant:   first[i].Variant,
+			Extension: first[i].Extension,
+			Size:      first[i].Size,
+			Width:     first[i].Width,
+			Height:    first[i].Height,
+			Existing:  true,
+		}) {
+			t.Errorf("Bad deduplicated result. Expected '%+v', got '%+v'", first[i], second[i])
+		}
+	}
+
+	other, err := r.ResizeImg(context.Background(), inputBuf, []Options{{Width: 64, Quality: 50}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other[0].BaseID == first[0].BaseID || other[0].Existing {
+		t.Errorf("Other options must give new thumbnail, got '%+v'", other[0])
+	}
+
+	files, _ := store.List(context.Background(), "", "", 0)
+	if len(files) != 3 {
+		t.Errorf("Bad count of saved files. Expected '3', got '%v'", len(files))
+	}
+
+	//уже сохранённые миниатюры ищутся до декодирования, поэтому исходник даже не разбирается
+	garbage := []byte("not an image")
+	variants := []Options{{Width: 64}}
+	NormalizeVariants(variants)
+	key := fileKey(r.layout, contentID(garbage, variants), variants, 0, false, ".jpeg")
+	thumb, _, _ := store.Get(context.Background(), first[0].Path)
+	data, _ := ioutil.ReadAll(thumb)
+	thumb.Close()
+	store.Put(context.Background(), key, data)
+	found, err := r.ResizeImg(context.Background(), garbage, []Options{{Width: 64}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found[0].Existing || found[0].Width != first[0].Width || found[0].Height != first[0].Height || found[0].Size != len(data) {
+		t.Errorf("Bad result found without decoding. Expected size of '%+v', got '%+v'", first[0], found[0])
+	}
+
+	expected := "preset= width=64 height=48 mode=fit format=auto quality=0 progressive=false lossless=false compression=0 accept=webp,png tenant=acme original=none"
+	if key := contentKey(Options{Width: 64, Height: 48, Mode: ModeFit, Format: FormatAuto, Accept: []Format{FormatWEBP, FormatPNG}, Tenant: "acme", Original: OriginalNone}); key != expected {
+		t.Errorf("Bad content key. Expected '%v', got '%v'", expected, key)
+	}
+}
+
+func TestHeaderSize(t *testing.T) {
+	jpegBuf, _ := ioutil.ReadFile("test_data/test_image.jpg")
+	var pngBuf bytes.Buffer
+	png.Encode(&pngBuf, image.NewRGBA(image.Rect(0, 0, 17, 9)))
+	riff := func(chunk string, data ...byte) []byte {
+		return append([]byte("RIFF\x00\x00\x00\x00WEBP"+chunk+"\x00\x00\x00\x00"), append(data, make([]byte, 10)...)...)
+	}
+
+	testCases := []struct {
+		Img            []byte
+		Type           vips.ImageType
+		ExpectedWidth  int
+		ExpectedHeight int
+		ExpectedOk     bool
+	}{
+		{jpegBuf, vips.ImageTypeJPEG, 5000, 2787, true},
+		{pngBuf.Bytes(), vips.ImageTypePNG, 17, 9, true},
+		{riff("VP8X", 0, 0, 0, 0, 99, 0, 0, 19, 0, 0), vips.ImageTypeWEBP, 100, 20, true},
+		{riff("VP8 ", 0, 0, 0, 0x9d, 0x01, 0x2a, 100, 0, 20, 0), vips.ImageTypeWEBP, 100, 20, true},
+		{riff("VP8L", 0x2f, 0x63, 0xc0, 0x04, 0), vips.ImageTypeWEBP, 100, 20, true},
+		{riff("VP8 ", 0, 0, 0, 0, 0, 0, 100, 0, 20, 0), vips.ImageTypeWEBP, 0, 0, false},
+		{[]byte("RIFF"), vips.ImageTypeWEBP, 0, 0, false},
+	}
+
+	for i, tCase := range testCases {
+		width, height, err := headerSize(bytes.NewReader(tCase.Img), tCase.Type)
+		if (err == nil) != tCase.ExpectedOk || width != tCase.ExpectedWidth || height != tCase.ExpectedHeight {
+			t.Errorf("Bad size in case %v. Expected '%vx%v', got '%vx%v' with error '%v'", i, tCase.ExpectedWidth, tCase.ExpectedHeight, width, height, err)
+		}
+	}
+}
+
+func TestNamingModeCheck(t *testing.T) {
+	defer config.Set(config.NamingMode, NamingRandom)
+
+	testCases := []struct {
+		Mode        string
+		Layout      string
+		ExpectedErr bool
+	}{
+		{NamingRandom, storage.LayoutDated, false},
+		{NamingContent, storage.LayoutFlat, false},
+		{NamingContent, "{tenant}/{shard}/{id}.{ext}", false},
+		{NamingContent, storage.LayoutDated, true},
+		{NamingContent, "{tenant}/{yyyy}/{id}.{ext}", true},
+		{"sequential", storage.LayoutFlat, true},
+	}
+
+	for _, tCase := range testCases {
+		config.Set(config.NamingMode, tCase.Mode)
+		layout, err := storage.NewLayout(tCase.Layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkNamingMode(layout); (err != nil) != tCase.ExpectedErr {
+			t.Errorf("Bad error for '%v' with '%v'. Expected error '%v', got '%v'", tCase.Mode, tCase.Layout, tCase.ExpectedErr, err)
+		}
+	}
+}
+
+func TestStorageLayout(t *testing.T) {
+	config.Set(config.StorageLayout, "{tenant}/{shard}/{id}.{ext}")
+	defer config.Set(config.StorageLayout, storage.LayoutFlat)
+
+	inputBuf, err := ioutil.ReadFile("test_data/test_image.jpg")
+	if err != nil {
+		t.Fatalf("failed to read input file, %s\n", err)
+	}
+	store := storage.NewMemory()
+	r := NewImgResizer(store)
+	defer r.Stop()
+
+	results, err := r.ResizeImg(context.Background(), inputBuf, []Options{{Width: 64, Tenant: "acme"}, {Width: 128, Tenant: "acme"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range results {
+		expected := "acme/" + res.ID[0:2] + "/" + res.ID[2:4] + "/" + res.ID + res.Extension
+		if res.Path != expected {
+			t.Errorf("Bad thumbnail path. Expected '%v', got '%v'", expected, res.Path)
+		}
+		if _, err := store.Stat(context.Background(), res.Path); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := r.ResizeImg(context.Background(), inputBuf, []Options{{Tenant: "../acme"}}); err == nil {
+		t.Errorf("Expected error for bad tenant")
+	}
+}
+
+func TestOriginal(t *testing.T) {
+	config.Set(config.OriginalMaxSide, 1000)
+	defer func() {
+		config.Set(config.OriginalMaxSide, 2048)
+		config.Set(config.KeepOriginal, OriginalNone)
+	}()
+
+	inputBuf, err := ioutil.ReadFile("test_data/test_image.jpg")
+	if err != nil {
+		t.Fatalf("failed to read input file, %s\n", err)
+	}
+
+	testCases := []struct {
+		Config          OriginalMode
+		Variants        []Options
+		ExpectedResults int
+		ExpectedWidth   int
+		ExpectedHeight  int
+		ExpectedSize    int
+	}{
+		{OriginalNone, []Options{{Width: 64}}, 1, 0, 0, 0},
+		{OriginalNone, []Options{{Width: 64, Original: OriginalSource}}, 2, 5000, 2787, len(inputBuf)},
+		{OriginalSource, []Options{{Width: 64}, {Width: 128}}, 3, 5000, 2787, len(inputBuf)},
+		{OriginalMaster, []Options{{Width: 64}}, 2, 1000, 557, 0},
+		{OriginalSource, []Options{{Width: 64, Original: OriginalNone}}, 1, 0, 0, 0},
+	}
+
+	for i, tCase := range testCases {
+		config.Set(config.KeepOriginal, tCase.Config)
+		store := storage.NewMemory()
+		r := NewImgResizer(store)
+
+		results, err := r.ResizeImg(context.Background(), inputBuf, tCase.Variants)
+		r.Stop()
+		if err != nil {
+			t.Fatalf("Error in case %v: %v", i, err)
+		}
+		if len(results) != tCase.ExpectedResults {
+			t.Errorf("Bad count of results in case %v. Expected '%v', got '%v'", i, tCase.ExpectedResults, len(results))
+			continue
+		}
+		if files, _ := store.List(context.Background(), "", "", 0); len(files) != tCase.ExpectedResults {
+			t.Errorf("Bad count of files in case %v. Expected '%v', got '%v'", i, tCase.ExpectedResults, len(files))
+		}
+		if tCase.ExpectedResults == len(tCase.Variants) {
+			continue
+		}
+
+		original := results[len(results)-1]
+		if original.ID != results[0].BaseID+"_original" || original.Variant != OriginalVariant || original.Extension != ".jpeg" {
+			t.Errorf("Bad original result in case %v. Got '%+v'", i, original)
+		}
+		if original.Width != tCase.ExpectedWidth || original.Height != tCase.ExpectedHeight {
+			t.Errorf("Bad original size in case %v. Expected '%vx%v', got '%vx%v'", i,
+				tCase.ExpectedWidth, tCase.ExpectedHeight, original.Width, original.Height)
+		}
+		if tCase.ExpectedSize != 0 && original.Size != tCase.ExpectedSize {
+			t.Errorf("Bad original file size in case %v. Expected '%v', got '%v'", i, tCase.ExpectedSize, original.Size)
+		}
+	}
+
+	config.Set(config.KeepOriginal, OriginalNone)
+	r := NewImgResizer(storage.NewMemory())
+	defer r.Stop()
+	if _, err := r.ResizeImg(context.Background(), inputBuf, []Options{{Width: 64, Original: "copy"}}); err == nil {
+		t.Errorf("Expected error for bad original mode")
+	}
+}
+
+func TestReprocess(t *testing.T) {
+	config.Set(config.Presets, "avatar=64x64 crop;card=320x200 fit")
+	defer config.Set(config.Presets, "")
+
+	inputBuf, err := ioutil.ReadFile("test_data/test_image.jpg")
+	if err != nil {
+		t.Fatalf("failed to read input file, %s\n", err)
+	}
+	store := storage.NewMemory()
+	r := NewImgResizer(store)
+	defer r.Stop()
+
+	results, err := r.Reprocess(context.Background(), inputBuf, "abc", []Options{{Preset: "card", Original: OriginalSource}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ID != "abc_card" || results[0].Path != "abc_card.jpeg" || results[0].Width != 320 || results[0].Height != 178 {
+		t.Errorf("Bad reprocessed thumbnail. Got '%+v'", results)
+	}
+	if files, _ := store.List(context.Background(), "", "", 0); len(files) != 1 {
+		t.Errorf("Bad count of files. Expected '1', got '%v'", len(files))
+	}
+}
+
+func TestRetentionGroups(t *testing.T) {
+	config.Set(config.RetentionMaxFiles, 3)
+	defer config.Set(config.RetentionMaxFiles, 0)
+
+	testCases := []struct {
+		Layout          string
+		Files           []string
+		ExpectedRemoved []string
+		ExpectedFiles   int
+	}{
+		{
+			Layout:          storage.LayoutFlat,
+			Files:           []string{"a_64x64_crop.png", "a_original.jpeg", "b.png", "x/a_card.png", "c.png"},
+			ExpectedRemoved: []string{"b.png", "a_64x64_crop.png", "a_original.jpeg", "x/a_card.png"},
+			ExpectedFiles:   1,
+		},
+		{
+			Layout:          "{tenant}_{id}.{ext}",
+			Files:           []string{"t1_a_64x64_crop.png", "t1_a_original.jpeg", "t1_b.png", "t2_a_card.png"},
+			ExpectedRemoved: []string{"t1_a_64x64_crop.png", "t1_a_original.jpeg"},
+			ExpectedFiles:   2,
+		},
+	}
+
+	for i, tCase := range testCases {
+		layout, err := storage.NewLayout(tCase.Layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		store := storage.NewMemory()
+		for _, name := range tCase.Files {
+			store.Put(ctx, name, []byte("abc"))
+			time.Sleep(2 * time.Millisecond)
+		}
+
+		report, err := sweep(ctx, store, layout, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(report.Removed, tCase.ExpectedRemoved) {
+			t.Errorf("Bad removed files in case %v. Expected '%v', got '%v'", i, tCase.ExpectedRemoved, report.Removed)
+		}
+		if report.Evicted != len(tCase.ExpectedRemoved) || report.Files != tCase.ExpectedFiles {
+			t.Errorf("Bad report in case %v. Got '%+v'", i, report)
+		}
+	}
+}
+
+func TestRetentionCheck(t *testing.T) {
+	defer func() {
+		config.Set(config.RetentionSweepIntervalSec, 300)
+		config.Set(config.RetentionMaxAgeSec, 0)
+		config.Set(config.RetentionMaxFiles, 0)
+		config.Set(config.RetentionMaxBytes, 0)
+	}()
+
+	testCases := []struct {
+		IntervalSec int
+		MaxAgeSec   int
+		MaxFiles    int
+		MaxBytes    int
+		ExpectOK    bool
+	}{
+		{300, 0, 0, 0, true},
+		{1, 60, 10, 1000, true},
+		{0, 0, 0, 0, false},
+		{-1, 0, 0, 0, false},
+		{300, -1, 0, 0, false},
+		{300, 0, -1, 0, false},
+		{300, 0, 0, -1, false},
+	}
+
+	for i, tCase := range testCases {
+		config.Set(config.RetentionSweepIntervalSec, tCase.IntervalSec)
+		config.Set(config.RetentionMaxAgeSec, tCase.MaxAgeSec)
+		config.Set(config.RetentionMaxFiles, tCase.MaxFiles)
+		config.Set(config.RetentionMaxBytes, tCase.MaxBytes)
+		if err := checkRetention(); (err == nil) != tCase.ExpectOK {
+			t.Errorf("Case %d. Bad check result. Expected ok '%v', got error '%v'", i, tCase.ExpectOK, err)
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	defer func() {
+		config.Set(config.RetentionMaxAgeSec, 0)
+		config.Set(config.RetentionMaxFiles, 0)
+		config.Set(config.RetentionMaxBytes, 0)
+		config.Set(config.RetentionPolicy, EvictOldest)
+	}()
+
+	testCases := []struct {
+		MaxAgeSec       int
+		MaxFiles        int
+		MaxBytes        int
+		Policy          string
+		Read            string
+		Now             time.Duration
+		ExpectedRemoved []string
+		ExpectedExpired int
+	}{
+		{MaxFiles: 2, Policy: EvictOldest, ExpectedRemoved: []string{"a.png", "b.png"}},
+		{MaxFiles: 2, Policy: EvictOldest, Read: "a.png", ExpectedRemoved: []string{"a.png", "b.png"}},
+		{MaxFiles: 2, Policy: EvictLRU, Read: "a.png", ExpectedRemoved: []string{"b.png", "c.png"}},
+		{MaxBytes: 5, Policy: EvictOldest, ExpectedRemoved: []string{"a.png", "b.png", "c.png"}},
+		{MaxAgeSec: 60, Policy: EvictOldest, Now: time.Hour, ExpectedRemoved: []string{"a.png", "b.png", "c.png", "d.png"}, ExpectedExpired: 4},
+		{MaxAgeSec: 60, Policy: EvictOldest},
+	}
+
+	layout, _ := storage.NewLayout(storage.LayoutFlat)
+	for i, tCase := range testCases {
+		config.Set(config.RetentionMaxAgeSec, tCase.MaxAgeSec)
+		config.Set(config.RetentionMaxFiles, tCase.MaxFiles)
+		config.Set(config.RetentionMaxBytes, tCase.MaxBytes)
+		config.Set(config.RetentionPolicy, tCase.Policy)
+
+		ctx := context.Background()
+		store := storage.NewTracked(storage.NewMemory())
+		for _, name := range []string{"a.png", "b.png", "c.png", "d.png"} {
+			store.Put(ctx, name, []byte("abc"))
+			time.Sleep(2 * time.Millisecond)
+		}
+		if tCase.Read != "" {
+			file, _, _ := store.Get(ctx, tCase.Read)
+			file.Close()
+		}
+
+		report, err := sweep(ctx, store, layout, time.Now().Add(tCase.Now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(report.Removed, tCase.ExpectedRemoved) {
+			t.Errorf("Bad removed files in case %v. Expected '%v', got '%v'", i, tCase.ExpectedRemoved, report.Removed)
+		}
+		if report.Expired != tCase.ExpectedExpired || report.Expired+report.Evicted != len(tCase.ExpectedRemoved) {
+			t.Errorf("Bad report in case %v. Got '%+v'", i, report)
+		}
+		if files, _ := store.List(ctx, "", "", 0); len(files) != report.Files || 4-len(files) != len(tCase.ExpectedRemoved) {
+			t.Errorf("Bad count of left files in case %v. Expected '%v', got '%v'", i, report.Files, len(files))
+		}
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	config.Set(config.RetentionMaxFiles, 1)
+	defer config.Set(config.RetentionMaxFiles, 0)
+
+	ctx := context.Background()
+	store := storage.NewMemory()
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		store.Put(ctx, name, []byte("abc"))
+	}
+
+	r := NewImgResizer(store)
+	defer r.Stop()
+	var files []storage.Info
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if files, _ = store.List(ctx, "", "", 0); len(files) == 1 {
+			break
+		}
+	}
+	if len(files) != 1 {
+		t.Errorf("Bad count of files after sweep. Expected '1', got '%v'", len(files))
+	}
+	r.Stop()
+}
+
+func TestResizeVariants(t *testing.T) {
 	config.Set(config.FileSaveDir, "test_out")
 	os.MkdirAll(config.GetString(config.FileSaveDir), os.ModePerm)
 	defer os.RemoveAll(config.GetString(config.FileSaveDir))
-	// decoder wants []byte, so read the whole file into a buffer
+
 	inputBuf, err := ioutil.ReadFile("test_data/test_image.jpg")
 	if err != nil {
 		t.Fatalf("failed to read input file, %s\n", err)
 	}
-	r := NewImgResizer()
-	if err = r.ResizeImg(inputBuf); err != nil {
+	r := NewImgResizer(storage.NewLocal(config.GetString(config.FileSaveDir)))
+	defer r.Stop()
+
+	variants := []Options{
+		{Width: 64},
+		{Width: 128, Mode: ModeFit},
+		{Width: 256, Height: 128},
+	}
+	results, err := r.ResizeImg(context.Background(), inputBuf, variants)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		Variant string
+		Width   int
+		Height  int
+	}{
+		{"64x64_crop", 64, 64},
+		{"128x128_fit", 128, 71},
+		{"256x128_crop", 256, 128},
+	}
+
+	if len(results) != len(expected) {
+		t.Fatalf("Bad count of results. Expected '%v', got '%v'", len(expected), len(results))
+	}
+
+	for i, res := range results {
+		if res.BaseID != results[0].BaseID {
+			t.Errorf("Bad base id. Expected '%v', got '%v'", results[0].BaseID, res.BaseID)
+		}
+		if res.Variant != expected[i].Variant || res.ID != res.BaseID+"_"+expected[i].Variant {
+			t.Errorf("Bad variant. Expected '%v', got '%v' with id '%v'", expected[i].Variant, res.Variant, res.ID)
+		}
+		if res.Width != expected[i].Width || res.Height != expected[i].Height {
+			t.Errorf("Bad size of variant '%v'. Expected '%vx%v', got '%vx%v'",
+				res.Variant, expected[i].Width, expected[i].Height, res.Width, res.Height)
+		}
+		if _, err := os.Stat(path.Join(config.GetString(config.FileSaveDir), res.ID+res.Extension)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestParsePresets(t *testing.T) {
+	testCases := []struct {
+		Presets         string
+		ExpectedPresets map[string]Options
+		ExpectedErr     bool
+	}{
+		{
+			Presets:         "",
+			ExpectedPresets: map[string]Options{},
+		},
+		{
+			Presets: "avatar=64x64 crop; card=320x200 fit webp q80;",
+			ExpectedPresets: map[string]Options{
+				"avatar": {Width: 64, Height: 64, Mode: ModeCrop},
+				"card":   {Width: 320, Height: 200, Mode: ModeFit, Format: FormatWEBP, Quality: 80},
+			},
+		},
+		{
+			Presets: "hero=1024x512 jpeg progressive;icon=32x32 png c9",
+			ExpectedPresets: map[string]Options{
+				"hero": {Width: 1024, Height: 512, Format: FormatJPEG, Progressive: true},
+				"icon": {Width: 32, Height: 32, Format: FormatPNG, Compression: 9},
+			},
+		},
+		{
+			Presets:     "avatar=64x64 png lossless",
+			ExpectedErr: true,
+		},
+		{
+			Presets:     "avatar=crop",
+			ExpectedErr: true,
+		},
+		{
+			Presets:     "avatar=64x64 zoom",
+			ExpectedErr: true,
+		},
+		{
+			Presets:     "64x64 crop",
+			ExpectedErr: true,
+		},
+	}
+
+	for _, tCase := range testCases {
+		presets, err := parsePresets(tCase.Presets)
+		if (err != nil) != tCase.ExpectedErr {
+			t.Errorf("Bad error for '%v'. Expected error '%v', got '%v'", tCase.Presets, tCase.ExpectedErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(presets, tCase.ExpectedPresets) {
+			t.Errorf("Bad presets for '%v'. Expected '%+v', got '%+v'", tCase.Presets, tCase.ExpectedPresets, presets)
+		}
+	}
+}
+
+func TestPresetsCache(t *testing.T) {
+	config.Set(config.Presets, "avatar=64x64 crop")
+	defer config.Set(config.Presets, "")
+
+	first, err := Presets()
+	if err != nil {
 		t.Fatal(err)
 	}
+	second, _ := Presets()
+	if reflect.ValueOf(first).Pointer() != reflect.ValueOf(second).Pointer() {
+		t.Errorf("Presets must be parsed once for the same config")
+	}
+
+	config.Set(config.Presets, "avatar=64x64 crop;card=320x200 fit")
+	if changed, _ := Presets(); len(changed) != 2 {
+		t.Errorf("Bad count of presets after config change. Expected '2', got '%v'", len(changed))
+	}
+	config.Set(config.Presets, "avatar=crop")
+	if _, err := Presets(); err == nil {
+		t.Errorf("Expected error for bad presets config")
+	}
 }
 
 func TestImgFromUrl(t *testing.T) {
@@ -58,26 +711,514 @@ func TestImgFromUrl(t *testing.T) {
 	os.MkdirAll(config.GetString(config.FileSaveDir), os.ModePerm)
 	defer os.RemoveAll(config.GetString(config.FileSaveDir))
 
-	r := NewImgResizer()
+	prevClient := client
 	client = &clientMockGetImage{}
-	if err := r.FromUrl("test_data/test_image.jpg"); err != nil {
+	defer func() { client = prevClient }()
+
+	r := NewImgResizer(storage.NewLocal(config.GetString(config.FileSaveDir)))
+	defer r.Stop()
+	if _, err := r.FromUrl(context.Background(), "test_data/test_image.jpg", []Options{{}}); err != nil {
 		t.Fatal(err)
 	}
 }
 
+//clientMockBlocking отвечает только после отмены контекста запроса
+type clientMockBlocking struct {
+	requests int32
+}
+
+func (c *clientMockBlocking) Do(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.requests, 1)
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+//TestSlowOrigin асинхронная загрузка с медленного источника ограничена AsyncJobTimeoutSec, а не JobTimeoutSec
+func TestSlowOrigin(t *testing.T) {
+	if config.FetchHTTPClient.Timeout != 0 {
+		t.Errorf("Fetch client must not have its own timeout. Got '%v'", config.FetchHTTPClient.Timeout)
+	}
+	prevClient := client
+	client = config.FetchHTTPClient
+	config.Set(config.JobTimeoutSec, 1)
+	defer func() {
+		client = prevClient
+		config.Set(config.JobTimeoutSec, 10)
+	}()
+
+	inputBuf, err := ioutil.ReadFile("test_data/test_image.jpg")
+	if err != nil {
+		t.Fatalf("failed to read input file, %s\n", err)
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			time.Sleep(1500 * time.Millisecond)
+		}
+		w.Write(inputBuf)
+	}))
+	defer origin.Close()
+
+	r := NewImgResizer(storage.NewMemory())
+	defer r.Stop()
+
+	id, err := r.SubmitUrl(context.Background(), origin.URL, []Options{{Width: 64}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	job, _ := r.Job(id)
+	for ; job.Status != JobDone && job.Status != JobFailed && time.Now().Before(deadline); job, _ = r.Job(id) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if job.Status != JobDone {
+		t.Errorf("Bad job status. Expected '%v', got '%v' with error '%v'", JobDone, job.Status, job.Error)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	prevClient := client
+	defer func() {
+		client = prevClient
+		config.Set(config.JobTimeoutSec, 10)
+	}()
+
+	inputBuf, err := ioutil.ReadFile("test_data/test_image.jpg")
+	if err != nil {
+		t.Fatalf("failed to read input file, %s\n", err)
+	}
+	config.Set(config.JobTimeoutSec, 1)
+	store := storage.NewMemory()
+	r := NewImgResizer(store)
+	defer r.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.ResizeImg(ctx, inputBuf, []Options{{Width: 64}, {Width: 128}}); err == nil {
+		t.Errorf("Expected error for canceled context")
+	}
+
+	blocking := &clientMockBlocking{}
+	client = blocking
+	start := time.Now()
+	_, err = r.FromUrl(context.Background(), "test_data/test_image.jpg", []Options{{}})
+	if err == nil || err.Error() != "Timout for request job" {
+		t.Errorf("Bad timeout error. Expected 'Timout for request job', got '%v'", err)
+	}
+	if time.Since(start) > 3*time.Second || atomic.LoadInt32(&blocking.requests) != 1 {
+		t.Errorf("Fetch must stop on timeout. Took '%v', requests '%v'", time.Since(start), blocking.requests)
+	}
+
+	//отменённые задачи не доходят до сохранения
+	time.Sleep(100 * time.Millisecond)
+	if files, _ := store.List(context.Background(), "", "", 0); len(files) != 0 {
+		t.Errorf("Bad count of saved files. Expected '0', got '%v'", len(files))
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	config.Set(config.EnqueueWaitMs, 10)
+	defer config.Set(config.EnqueueWaitMs, 100)
+
+	inputBuf, err := ioutil.ReadFile("test_data/test_image.jpg")
+	if err != nil {
+		t.Fatalf("failed to read input file, %s\n", err)
+	}
+	//очереди без воркеров заполняются первой задачей
+	r := &ImgResizer{
+		resizeChan:     newLanes[imgJob](1, 1, newLanePicker(1, 1)),
+		requestImgChan: newLanes[requestJob](1, 1, newLanePicker(1, 1)),
+		done:           &rateMeter{},
+		jobs:           newJobStore(),
+		asyncCtx:       context.Background(),
+	}
+	for i := 0; i < 20; i++ {
+		r.done.add(time.Now())
+	}
+	r.resizeChan.lanes[laneInteractive] <- imgJob{}
+
+	_, err = r.ResizeImg(context.Background(), inputBuf, []Options{{}})
+	qf, ok := err.(*QueueFullError)
+	if !ok {
+		t.Fatalf("Bad error. Expected '*QueueFullError', got '%v'", err)
+	}
+	if qf.Queue != "resize" || qf.Depth != 1 || qf.RetryAfter != time.Second {
+		t.Errorf("Bad queue full error. Got '%+v'", qf)
+	}
+
+	//асинхронная задача отклоняется сразу и не создаётся
+	id, err := r.SubmitImg(context.Background(), inputBuf, []Options{{}}, "")
+	if _, ok := err.(*QueueFullError); !ok || id != "" || len(r.jobs.jobs) != 0 {
+		t.Errorf("Bad async error. Expected '*QueueFullError' without job, got '%v', id '%v', jobs %v", err, id, len(r.jobs.jobs))
+	}
+
+	//неудачные задачи не считаются в пропускной способности
+	rate := r.done.rate(time.Now())
+	r.finished(nil, fmt.Errorf("resize error"))
+	if res := r.done.rate(time.Now()); res != rate {
+		t.Errorf("Bad rate after failed job. Expected '%v', got '%v'", rate, res)
+	}
+
+	r.requestImgChan.lanes[laneInteractive] <- requestJob{}
+	if _, err = r.FromUrl(context.Background(), "test_data/test_image.jpg", []Options{{}}); err == nil || err.Error() != "The request queue is full" {
+		t.Errorf("Bad error. Expected 'The request queue is full', got '%v'", err)
+	}
+
+	//внутренняя задача ждёт, пока в очереди освободится место
+	ctx, cancel := context.WithCancel(WithQueueWait(context.Background()))
+	var waitErr = make(chan error, 1)
+	go func() {
+		_, err := r.ResizeImg(ctx, inputBuf, []Options{{}})
+		waitErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	<-r.resizeChan.lanes[laneInteractive]
+	for start := time.Now(); r.resizeChan.len(laneInteractive) == 0 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+	if job := <-r.resizeChan.lanes[laneInteractive]; job.img == nil {
+		t.Errorf("Waiting job must be queued after the queue is freed")
+	}
+	cancel()
+	if err := <-waitErr; err == nil {
+		t.Errorf("Expected error for canceled job")
+	} else if _, ok := err.(*QueueFullError); ok {
+		t.Errorf("Waiting job must not be rejected, got '%v'", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	testCases := []struct {
+		Depth    int
+		Rate     float64
+		Expected time.Duration
+	}{
+		{0, 10, time.Second},
+		{49, 10, 5 * time.Second},
+		{10, 0, 60 * time.Second},
+		{1000, 1, 60 * time.Second},
+	}
+	for _, tCase := range testCases {
+		if res := retryAfter(tCase.Depth, tCase.Rate); res != tCase.Expected {
+			t.Errorf("Bad retry after for '%+v'. Expected '%v', got '%v'", tCase, tCase.Expected, res)
+		}
+	}
+
+	var m rateMeter
+	now := time.Now()
+	for i := 0; i < 30; i++ {
+		m.add(now.Add(-time.Duration(i) * time.Second))
+	}
+	if rate := m.rate(now); rate != 1 {
+		t.Errorf("Bad rate. Expected '1', got '%v'", rate)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	//под -race ресайз медленный: принятые задачи не должны упираться в таймаут
+	config.Set(config.JobTimeoutSec, 120)
+	defer config.Set(config.JobTimeoutSec, 10)
+
+	inputBuf, err := ioutil.ReadFile("test_data/test_image.jpg")
+	if err != nil {
+		t.Fatalf("failed to read input file, %s\n", err)
+	}
+	store := storage.NewMemory()
+	r := NewImgResizer(store)
+	defer r.Stop()
+
+	//принятые до остановки задачи доводятся до сохранения, остальные отклоняются
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var saved, stopped, full int
+	var failed []error
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.ResizeImg(context.Background(), inputBuf, []Options{{Width: 64}})
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := err.(*QueueFullError); ok {
+				full++
+				return
+			}
+			switch err {
+			case nil:
+				saved++
+			case ErrStopped:
+				stopped++
+			default:
+				failed = append(failed, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if len(failed) != 0 {
+		t.Errorf("Accepted jobs must be finished. Got errors '%v'", failed)
+	}
+	if saved+stopped+full != 20 {
+		t.Errorf("Bad count of jobs. Saved '%v', stopped '%v', queue full '%v'", saved, stopped, full)
+	}
+	if files, _ := store.List(context.Background(), "", "", 0); len(files) != saved {
+		t.Errorf("Bad count of saved files. Expected '%v', got '%v'", saved, len(files))
+	}
+	if _, err := r.ResizeImg(context.Background(), inputBuf, []Options{{Width: 64}}); err != ErrStopped {
+		t.Errorf("Bad error after shutdown. Expected '%v', got '%v'", ErrStopped, err)
+	}
+
+	//повторная остановка, например по второму сигналу, не паникует
+	r.Stop()
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Errorf("Bad repeated shutdown. Expected '%v', got '%v'", nil, err)
+	}
+}
+
+func TestShutdownCallbacks(t *testing.T) {
+	config.Set(config.CallbackRetryDelayMs, 50)
+	config.Set(config.CallbackMaxAttempts, 100)
+	dir, err := ioutil.TempDir("", "dead_letter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetterFile := path.Join(dir, "dead_letter.log")
+	config.Set(config.CallbackDeadLetterFile, deadLetterFile)
+	defer func() {
+		config.Set(config.CallbackRetryDelayMs, 1000)
+		config.Set(config.CallbackMaxAttempts, 5)
+		config.Set(config.CallbackDeadLetterFile, "")
+		os.RemoveAll(dir)
+	}()
+
+	inputBuf, err := ioutil.ReadFile("test_data/test_image.jpg")
+	if err != nil {
+		t.Fatalf("failed to read input file, %s\n", err)
+	}
+	var delivered int32
+	okServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&delivered, 1)
+	}))
+	defer okServer.Close()
+	failServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failServer.Close()
+
+	//остановка дожидается отправки callback
+	r := NewImgResizer(storage.NewMemory())
+	defer r.Stop()
+	if _, err := r.SubmitImg(context.Background(), inputBuf, []Options{{Width: 64}}, okServer.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&delivered); n != 1 {
+		t.Errorf("Bad count of delivered callbacks. Expected '%v', got '%v'", 1, n)
+	}
+
+	//callback, который не успел отправиться за время остановки, попадает в dead letter
+	r = NewImgResizer(storage.NewMemory())
+	defer r.Stop()
+	id, err := r.SubmitImg(context.Background(), inputBuf, []Options{{Width: 64}}, failServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Bad shutdown error. Expected '%v', got '%v'", context.DeadlineExceeded, err)
+	}
+	r.Stop()
+	data, _ := ioutil.ReadFile(deadLetterFile)
+	if !bytes.Contains(data, []byte(id)) {
+		t.Errorf("Pending callback must be dead lettered. Got '%s'", data)
+	}
+}
+
+func TestRenderUrl(t *testing.T) {
+	config.Set(config.FileSaveDir, "test_out")
+	os.MkdirAll(config.GetString(config.FileSaveDir), os.ModePerm)
+	defer os.RemoveAll(config.GetString(config.FileSaveDir))
+
+	r := NewImgResizer(storage.NewLocal(config.GetString(config.FileSaveDir)))
+	defer r.Stop()
+	client = &clientMockGetImage{}
+
+	res, err := r.RenderUrl(context.Background(), "test_data/test_image.jpg", Options{Width: 64}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Data) == 0 || len(res.Data) != res.Size {
+		t.Errorf("Bad rendered data size. Expected '%v', got '%v'", res.Size, len(res.Data))
+	}
+	if _, err := os.Stat(path.Join(config.GetString(config.FileSaveDir), res.ID+res.Extension)); !os.IsNotExist(err) {
+		t.Errorf("Rendered thumbnail without id must not be saved, got '%v'", err)
+	}
+
+	res, err = r.RenderUrl(context.Background(), "test_data/test_image.jpg", Options{Width: 64}, "cached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != "cached" {
+		t.Errorf("Bad rendered thumbnail id. Expected 'cached', got '%v'", res.ID)
+	}
+	if _, err := os.Stat(path.Join(config.GetString(config.FileSaveDir), "cached"+res.Extension)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAsyncJobs(t *testing.T) {
+	config.Set(config.FileSaveDir, "test_out")
+	os.MkdirAll(config.GetString(config.FileSaveDir), os.ModePerm)
+	defer os.RemoveAll(config.GetString(config.FileSaveDir))
+	defer config.Set(config.JobTTLSec, 3600)
+
+	r := NewImgResizer(storage.NewLocal(config.GetString(config.FileSaveDir)))
+	defer r.Stop()
+	inputBuf, _ := ioutil.ReadFile("test_data/test_image.jpg")
+
+	testCases := []struct {
+		Img            []byte
+		Variants       []Options
+		ExpectedStatus JobState
+		ExpectedCount  int
+	}{
+		{
+			Img:            inputBuf,
+			Variants:       []Options{{Width: 64}, {Width: 128}},
+			ExpectedStatus: JobDone,
+			ExpectedCount:  2,
+		},
+		{
+			Img:            []byte{},
+			Variants:       []Options{{}},
+			ExpectedStatus: JobFailed,
+		},
+	}
+
+	for i, tCase := range testCases {
+		id, err := r.SubmitImg(context.Background(), tCase.Img, tCase.Variants, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var job JobStatus
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			job, _ = r.Job(id)
+			if job.Status == JobDone || job.Status == JobFailed {
+				break
+			}
+		}
+
+		if job.Status != tCase.ExpectedStatus {
+			t.Errorf("Bad job status in case %v. Expected '%v', got '%v' (%v)", i, tCase.ExpectedStatus, job.Status, job.Error)
+		}
+		if len(job.Results) != tCase.ExpectedCount {
+			t.Errorf("Bad results count in case %v. Expected '%v', got '%v'", i, tCase.ExpectedCount, len(job.Results))
+		}
+	}
+
+	id, _ := r.SubmitImg(context.Background(), []byte{}, []Options{{}}, "")
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if job, _ := r.Job(id); job.Status == JobFailed {
+			break
+		}
+	}
+	//ttl меняется после остановки, когда воркеры уже не читают конфиг
+	r.Stop()
+	config.Set(config.JobTTLSec, 0)
+	time.Sleep(time.Millisecond)
+	if _, ok := r.Job(id); ok {
+		t.Errorf("Finished job must expire after ttl")
+	}
+}
+
+func TestJobCallback(t *testing.T) {
+	config.Set(config.FileSaveDir, "test_out")
+	os.MkdirAll(config.GetString(config.FileSaveDir), os.ModePerm)
+	defer os.RemoveAll(config.GetString(config.FileSaveDir))
+	config.Set(config.CallbackSecret, "secret")
+	config.Set(config.CallbackRetryDelayMs, 1)
+	config.Set(config.CallbackMaxAttempts, 3)
+	deadLetterFile := path.Join(config.GetString(config.FileSaveDir), "dead_letter.log")
+	config.Set(config.CallbackDeadLetterFile, deadLetterFile)
+	defer func() {
+		config.Set(config.CallbackSecret, "")
+		config.Set(config.CallbackRetryDelayMs, 1000)
+		config.Set(config.CallbackMaxAttempts, 5)
+		config.Set(config.CallbackDeadLetterFile, "")
+	}()
+
+	var received = make(chan callbackPayload, 1)
+	var attempts int32
+	okServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if sign := req.Header.Get(SignatureHeader); sign != "sha256="+SignCallback([]byte("secret"), body) {
+			t.Errorf("Bad callback signature. Got '%v'", sign)
+		}
+		var payload callbackPayload
+		json.Unmarshal(body, &payload)
+		received <- payload
+	}))
+	defer okServer.Close()
+
+	failServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failServer.Close()
+
+	r := NewImgResizer(storage.NewLocal(config.GetString(config.FileSaveDir)))
+	defer r.Stop()
+	inputBuf, _ := ioutil.ReadFile("test_data/test_image.jpg")
+
+	id, err := r.SubmitImg(context.Background(), inputBuf, []Options{{Width: 64}}, okServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case payload := <-received:
+		if payload.ID != id || payload.Status != JobDone || len(payload.Thumbnails) != 1 {
+			t.Errorf("Bad callback payload. Got '%+v'", payload)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Callback was not received")
+	}
+
+	id, _ = r.SubmitImg(context.Background(), []byte{}, []Options{{}}, failServer.URL)
+	var deadLetter []byte
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if deadLetter, _ = ioutil.ReadFile(deadLetterFile); len(deadLetter) > 0 {
+			break
+		}
+	}
+	if !bytes.Contains(deadLetter, []byte(id)) {
+		t.Errorf("Failed callback must be written to dead letter. Got '%s'", deadLetter)
+	}
+}
+
 func BenchmarkResizeAndSaveConcurency(b *testing.B) {
 	config.Set(config.FileSaveDir, "test_out")
 	os.MkdirAll(config.GetString(config.FileSaveDir), os.ModePerm)
 	defer os.RemoveAll(config.GetString(config.FileSaveDir))
 
-	r := NewImgResizer()
+	r := NewImgResizer(storage.NewLocal(config.GetString(config.FileSaveDir)))
+	defer r.Stop()
 	inputBuf, _ := ioutil.ReadFile("test_data/test_image.jpg")
 	b.N = 200
 	wg := sync.WaitGroup{}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		go func() {
-			err := r.ResizeImg(inputBuf)
+			_, err := r.ResizeImg(context.Background(), inputBuf, []Options{{}})
 			if err != nil {
 				b.Error(err.Error())
 			}
@@ -92,18 +1233,207 @@ func BenchmarkResizeAndSaveConcurency(b *testing.B) {
 func BenchmarkResizeConcureny(b *testing.B) {
 	inputBuf, _ := ioutil.ReadFile("test_data/test_image.jpg")
 	b.N = 200
+	variants := []Options{{}}
+	NormalizeVariants(variants)
 	inJob := imgJob{
-		img: inputBuf,
-		err: make(chan error),
+		img:      inputBuf,
+		variants: variants,
+		ctx:      context.Background(),
+		err:      make(chan jobResult),
 	}
-	inChan := make(chan imgJob)
-	outChan := make(chan imgJob, b.N)
-	startResizeWorkerPool(&sync.WaitGroup{}, inChan, outChan)
+	inChan := newLanes[imgJob](0, 0, newLanePicker(1, 1))
+	outChan := newLanes[imgJob](b.N, b.N, newLanePicker(1, 1))
+	layout, _ := storage.NewLayout(storage.LayoutFlat)
+	newResizeWorkerPool(&sync.WaitGroup{}, inChan, outChan, storage.NewMemory(), layout).start()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		inChan <- inJob
+		inChan.push(inJob.ctx, inJob, nil, nil)
 	}
 	for i := 0; i < b.N; i++ {
-		<-outChan
+		outChan.pop(nil)
+	}
+}
+
+func TestLanes(t *testing.T) {
+	testCases := []struct {
+		Interactive int
+		Bulk        int
+		Expected    []int
+	}{
+		{1, 1, []int{laneInteractive, laneBulk}},
+		{4, 1, []int{laneInteractive, laneBulk, laneInteractive, laneInteractive, laneInteractive}},
+		{3, 2, []int{laneInteractive, laneBulk, laneInteractive, laneBulk, laneInteractive}},
+	}
+	for _, tCase := range testCases {
+		p := newLanePicker(tCase.Interactive, tCase.Bulk)
+		var res []int
+		for range tCase.Expected {
+			res = append(res, p.order()[0])
+		}
+		if !reflect.DeepEqual(res, tCase.Expected) {
+			t.Errorf("Bad lane order for '%+v'. Expected '%v', got '%v'", tCase, tCase.Expected, res)
+		}
+	}
+
+	//обе полосы заполнены: массовые задачи идут по весу, а не после всех интерактивных
+	q := newLanes[imgJob](10, 10, newLanePicker(4, 1))
+	bulk := WithPriority(context.Background(), PriorityBulk)
+	for i := 0; i < 10; i++ {
+		q.push(context.Background(), imgJob{baseID: "i"}, nil, nil)
+		q.push(bulk, imgJob{baseID: "b"}, nil, nil)
+	}
+	var order string
+	for i := 0; i < 10; i++ {
+		job, _ := q.pop(nil)
+		order += job.baseID
+	}
+	if order != "ibiiiibiii" {
+		t.Errorf("Bad pop order. Expected '%v', got '%v'", "ibiiiibiii", order)
+	}
+
+	//пустая полоса не задерживает другую
+	q = newLanes[imgJob](10, 10, newLanePicker(4, 1))
+	q.push(bulk, imgJob{baseID: "b"}, nil, nil)
+	if job, ok := q.pop(nil); !ok || job.baseID != "b" {
+		t.Errorf("Bad pop from bulk lane. Expected '%v', got '%v'", "b", job.baseID)
+	}
+
+	q.close()
+	if _, ok := q.pop(nil); ok {
+		t.Errorf("Bad pop from closed lanes. Expected '%v', got '%v'", false, ok)
+	}
+}
+
+type queueMock struct {
+	len, cap int
+}
+
+func (q *queueMock) depth() int    { return q.len }
+func (q *queueMock) capacity() int { return q.cap }
+
+func TestAutoscale(t *testing.T) {
+	config.Set(config.AutoscaleDownTicks, 2)
+	defer config.Set(config.AutoscaleDownTicks, 5)
+
+	//воркеры ничего не делают и завершаются только по сигналу retire
+	var alive int32
+	var wg sync.WaitGroup
+	queue := &queueMock{cap: 10}
+	p := &workerPool{
+		stage:         "test",
+		initial:       1,
+		min:           2,
+		max:           5,
+		targetLatency: 100 * time.Millisecond,
+		queue:         queue,
+		wg:            &wg,
+		retire:        make(chan struct{}, 5),
+		worker: func(p *workerPool) {
+			defer p.wg.Done()
+			atomic.AddInt32(&alive, 1)
+			<-p.retire
+			atomic.AddInt32(&alive, -1)
+		},
+	}
+	p.start()
+	if p.size != 2 {
+		t.Fatalf("Bad start size. Expected '%v', got '%v'", 2, p.size)
+	}
+
+	testCases := []struct {
+		Depth    int
+		Latency  time.Duration
+		Expected int
+	}{
+		{6, 0, 3},
+		{6, 0, 4},
+		{5, 0, 5},
+		{9, 0, 5},
+		{1, 0, 5},
+		{0, 0, 4},
+		{0, 0, 4},
+		{3, 0, 4},
+		{0, 0, 4},
+		{0, 0, 3},
+		{1, 200 * time.Millisecond, 4},
+		{0, 0, 4},
+		{0, 0, 3},
+		{0, 0, 3},
+		{0, 0, 2},
+		{0, 0, 2},
+		{0, 0, 2},
+	}
+	for i, tCase := range testCases {
+		queue.len = tCase.Depth
+		if tCase.Latency > 0 {
+			p.observe(time.Now().Add(-tCase.Latency))
+		}
+		p.tick(time.Now())
+		if p.size != tCase.Expected {
+			t.Errorf("Step %d. Bad pool size. Expected '%v', got '%v'", i, tCase.Expected, p.size)
+		}
+	}
+
+	status := p.status()
+	if len(status.Decisions) != 8 || status.Decisions[0].Reason != "queue is 60% full" || status.Decisions[0].From != 2 || status.Decisions[0].To != 3 {
+		t.Errorf("Bad decisions. Got '%+v'", status.Decisions)
+	}
+	if status.Decisions[5].Reason != "latency 200ms is over 100ms" {
+		t.Errorf("Bad latency decision. Got '%+v'", status.Decisions)
+	}
+
+	//лишние воркеры завершаются без закрытия очереди
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&alive) != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&alive); n != 2 {
+		t.Errorf("Bad count of running workers. Expected '%v', got '%v'", 2, n)
+	}
+
+	for i := 0; i < 2; i++ {
+		p.retire <- struct{}{}
+	}
+	wg.Wait()
+}
+
+func TestAutoscaleShutdown(t *testing.T) {
+	config.Set(config.AutoscaleIntervalMs, 5)
+	config.Set(config.ResizeWorkerMin, 1)
+	config.Set(config.ResizeWorkerMax, 20)
+	defer func() {
+		config.Set(config.AutoscaleIntervalMs, 1000)
+		config.Set(config.ResizeWorkerMin, config.GetInt(config.ResizeWorkerCount))
+		config.Set(config.ResizeWorkerMax, config.GetInt(config.ResizeWorkerCount))
+	}()
+
+	inputBuf, err := ioutil.ReadFile("test_data/test_image.jpg")
+	if err != nil {
+		t.Fatalf("failed to read input file, %s\n", err)
+	}
+	r := NewImgResizer(storage.NewMemory())
+	defer r.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.ResizeImg(context.Background(), inputBuf, []Options{{Width: 64}})
+		}()
+	}
+	wg.Wait()
+
+	var resize PoolStatus
+	for _, s := range r.Workers() {
+		if s.Stage == "resize" {
+			resize = s
+		}
+	}
+	if resize.Min != 1 || resize.Max != 20 || resize.Workers < 1 || resize.Workers > 20 {
+		t.Errorf("Bad resize pool status. Got '%+v'", resize)
+	}
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
 	}
 }
@@ -0,0 +1,241 @@
+package resizer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"staply_img_resizer/config"
+	"staply_img_resizer/storage"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Политики вытеснения для config.RetentionPolicy
+const (
+	//EvictOldest удалять сначала самые старые миниатюры
+	EvictOldest = "oldest"
+	//EvictLRU удалять сначала миниатюры, которые дольше всего не читались
+	EvictLRU = "lru"
+)
+
+//SweepReport итог одного прохода сборщика миниатюр
+type SweepReport struct {
+	//Expired количество файлов, удалённых по возрасту
+	Expired int
+	//Evicted количество файлов, удалённых по лимитам количества и размера
+	Evicted    int
+	FreedBytes int64
+	//Files и Bytes количество и размер оставшихся файлов
+	Files   int
+	Bytes   int64
+	Removed []string
+}
+
+//accessTracker хранилище, знающее время последнего чтения файлов, например storage.Tracked
+type accessTracker interface {
+	LastAccess(name string) (time.Time, bool)
+}
+
+func checkRetention() error {
+	switch policy := config.GetString(config.RetentionPolicy); policy {
+	case EvictOldest, EvictLRU:
+	default:
+		return fmt.Errorf("unknown retention policy '%s'", policy)
+	}
+	if n := config.GetInt(config.RetentionSweepIntervalSec); n <= 0 {
+		return fmt.Errorf("retention sweep interval must be positive, got %d", n)
+	}
+	if n := config.GetInt64(config.RetentionMaxAgeSec); n < 0 {
+		return fmt.Errorf("retention max age must not be negative, got %d", n)
+	}
+	if n := config.GetInt64(config.RetentionMaxBytes); n < 0 {
+		return fmt.Errorf("retention max bytes must not be negative, got %d", n)
+	}
+	if n := config.GetInt(config.RetentionMaxFiles); n < 0 {
+		return fmt.Errorf("retention max files must not be negative, got %d", n)
+	}
+	return nil
+}
+
+func retentionEnabled() bool {
+	return config.GetInt64(config.RetentionMaxAgeSec) > 0 ||
+		config.GetInt64(config.RetentionMaxBytes) > 0 ||
+		config.GetInt(config.RetentionMaxFiles) > 0
+}
+
+//fileGroup общий ID файла в хранилище. Варианты миниатюры и её исходник сохраняются с ID
+//{base_id}_{variant}, а в base_id нет "_", поэтому группа - владелец и ID из пути по layout до первого "_".
+//Если путь не разбирается по layout, ID - имя файла без расширения
+func fileGroup(layout *storage.Layout, name string) string {
+	var tenant, id string
+	if fields, ok := layout.Parse(name); ok {
+		tenant, id = fields.Tenant, fields.ID
+		if fields.BaseID != "" {
+			id = fields.BaseID
+		}
+	} else {
+		id = path.Base(name)
+		id = strings.TrimSuffix(id, path.Ext(id))
+	}
+	if i := strings.Index(id, "_"); i >= 0 {
+		id = id[:i]
+	}
+	return tenant + "/" + id
+}
+
+//retentionGroup файлы с общим ID, которые удаляются только вместе
+type retentionGroup struct {
+	files []storage.Info
+	size  int64
+	//modTime и lastUsed время самого нового файла группы
+	modTime  time.Time
+	lastUsed time.Time
+}
+
+//sweep удаляет файлы старше config.RetentionMaxAgeSec, а затем, пока превышены
+//config.RetentionMaxFiles или config.RetentionMaxBytes, вытесняет файлы по config.RetentionPolicy.
+//Миниатюры с общим ID и исходник удаляются группой: группа устаревает по самому новому файлу
+func sweep(ctx context.Context, store storage.Storage, layout *storage.Layout, now time.Time) (SweepReport, error) {
+	var report SweepReport
+	files, err := store.List(ctx, "", "", 0)
+	if err != nil {
+		return report, err
+	}
+
+	lastUsed := func(file storage.Info) time.Time {
+		if tracker, ok := store.(accessTracker); ok && config.GetString(config.RetentionPolicy) == EvictLRU {
+			if at, ok := tracker.LastAccess(file.Name); ok && at.After(file.ModTime) {
+				return at
+			}
+		}
+		return file.ModTime
+	}
+
+	var groups []*retentionGroup
+	var byID = make(map[string]*retentionGroup)
+	for _, file := range files {
+		id := fileGroup(layout, file.Name)
+		group, ok := byID[id]
+		if !ok {
+			group = &retentionGroup{}
+			byID[id] = group
+			groups = append(groups, group)
+		}
+		group.files = append(group.files, file)
+		group.size += file.Size
+		if file.ModTime.After(group.modTime) {
+			group.modTime = file.ModTime
+		}
+		if at := lastUsed(file); at.After(group.lastUsed) {
+			group.lastUsed = at
+		}
+	}
+
+	var maxAge = time.Second * config.GetDuration(config.RetentionMaxAgeSec)
+	var kept []*retentionGroup
+	for _, group := range groups {
+		if maxAge > 0 && now.Sub(group.modTime) > maxAge {
+			if err := removeGroup(ctx, store, group, &report); err != nil {
+				return report, err
+			}
+			report.Expired += len(group.files)
+			continue
+		}
+		kept = append(kept, group)
+		report.Files += len(group.files)
+		report.Bytes += group.size
+	}
+
+	sort.SliceStable(kept, func(i, j int) bool {
+		return kept[i].lastUsed.Before(kept[j].lastUsed)
+	})
+
+	var maxFiles = config.GetInt(config.RetentionMaxFiles)
+	var maxBytes = config.GetInt64(config.RetentionMaxBytes)
+	for _, group := range kept {
+		if (maxFiles <= 0 || report.Files <= maxFiles) && (maxBytes <= 0 || report.Bytes <= maxBytes) {
+			break
+		}
+		if err := removeGroup(ctx, store, group, &report); err != nil {
+			return report, err
+		}
+		report.Evicted += len(group.files)
+		report.Files -= len(group.files)
+		report.Bytes -= group.size
+	}
+	return report, nil
+}
+
+func removeGroup(ctx context.Context, store storage.Storage, group *retentionGroup, report *SweepReport) error {
+	for _, file := range group.files {
+		if err := removeFile(ctx, store, file, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeFile(ctx context.Context, store storage.Storage, file storage.Info, report *SweepReport) error {
+	err := store.Delete(ctx, file.Name)
+	if err == storage.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't remove %s; error %v", file.Name, err)
+	}
+	report.FreedBytes += file.Size
+	report.Removed = append(report.Removed, file.Name)
+	return nil
+}
+
+//startSweeper запускает сборщик, который проходит по хранилищу при старте
+//и затем каждые config.RetentionSweepIntervalSec, пока не закрыт stop
+func startSweeper(wg *sync.WaitGroup, store storage.Storage, layout *storage.Layout, stop <-chan struct{}) {
+	if !retentionEnabled() {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	interval := time.Second * config.GetDuration(config.RetentionSweepIntervalSec)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			report, err := sweep(ctx, store, layout, time.Now())
+			logSweep(report, err)
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	log.Printf("Retention sweeper is running every %v", interval)
+}
+
+func logSweep(report SweepReport, err error) {
+	if err != nil {
+		log.Printf("Retention sweep error: %v", err)
+	}
+	if len(report.Removed) == 0 {
+		return
+	}
+
+	removed := report.Removed
+	if len(removed) > 100 {
+		removed = removed[:100]
+	}
+	log.Printf("Retention sweep: expired %d, evicted %d, freed %d bytes, left %d files (%d bytes); removed %v",
+		report.Expired, report.Evicted, report.FreedBytes, report.Files, report.Bytes, removed)
+}
@@ -0,0 +1,320 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"staply_img_resizer/config"
+	"staply_img_resizer/resizer"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	batchPath      = "/batch"
+	ndjsonMimeType = "application/x-ndjson"
+)
+
+//batchItem элемент пакетного запроса: url или изображение в base64 со своими параметрами миниатюр.
+//Вместо объекта можно передать строку с url
+type batchItem struct {
+	URL   string `json:"url"`
+	Image []byte `json:"image"`
+	variantsRequest
+}
+
+func (item *batchItem) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &item.URL)
+	}
+
+	type plain batchItem
+	return json.Unmarshal(data, (*plain)(item))
+}
+
+//batchResult результат обработки одного элемента пакетного запроса
+type batchResult struct {
+	Index   int               `json:"index"`
+	URL     string            `json:"url,omitempty"`
+	Results []*resizer.Result `json:"results,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+//batch пакетное создание миниатюр: POST /batch с json массивом элементов
+//или с ndjson, по элементу на строку. Ошибки возвращаются для каждого элемента отдельно.
+//Для ndjson или Accept: application/x-ndjson результаты отдаются ndjson по мере готовности
+func (router *Router) batch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("The path with this method is missing."))
+		return
+	}
+
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	duplex := batchDeadlines(w, mt == ndjsonMimeType)
+	if _, err = resizer.ParsePriority(r.URL.Query().Get("priority")); err != nil {
+		http.Error(w, "Bad value of parameter 'priority': "+r.URL.Query().Get("priority"), http.StatusBadRequest)
+		return
+	}
+
+	var items = make(chan batchInput)
+	var results = make(chan batchResult)
+	var inputDone = make(chan struct{})
+
+	switch mt {
+	case "application/json":
+		body := http.MaxBytesReader(w, r.Body, config.GetInt64(config.MaxBatchBodyByte))
+		list, err := decodeBatchList(body, config.GetInt(config.MaxBatchItems))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte(fmt.Sprintf("Batch body is too large. Max bytes: %d", tooLarge.Limit)))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if len(list) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Batch cannot be empty"))
+			return
+		}
+
+		go func() {
+			for i, item := range list {
+				items <- batchInput{index: i, item: item}
+			}
+			close(items)
+			close(inputDone)
+		}()
+	case ndjsonMimeType:
+		go func() {
+			readNDJSON(r, items)
+			close(inputDone)
+		}()
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Underfined content-type for batch:" + r.Header.Get("Content-Type")))
+		return
+	}
+
+	go router.processBatch(r, items, results)
+
+	if mt == ndjsonMimeType || strings.Contains(r.Header.Get("Accept"), ndjsonMimeType) {
+		writeBatchNDJSON(w, results, inputDone, duplex)
+		return
+	}
+
+	var list []batchResult
+	for res := range results {
+		list = append(list, res)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Index < list[j].Index
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+}
+
+//decodeBatchList читает json массив элементов пакета. Чтение прекращается,
+//как только элементов становится больше limit
+func decodeBatchList(r io.Reader, limit int) ([]batchItem, error) {
+	dec := json.NewDecoder(r)
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if t != json.Delim('[') {
+		return nil, fmt.Errorf("Batch must be a json array")
+	}
+
+	var list []batchItem
+	for dec.More() {
+		if len(list) == limit {
+			return nil, fmt.Errorf("Batch is too large. Max items: %d", limit)
+		}
+		var item batchItem
+		if err := dec.Decode(&item); err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+//CheckBatch проверяет настройки пакетных запросов
+func CheckBatch() error {
+	if n := config.GetInt(config.BatchConcurrency); n < 1 {
+		return fmt.Errorf("batch concurrency must be positive, got %d", n)
+	}
+	if n := config.GetInt(config.MaxBatchItems); n < 1 {
+		return fmt.Errorf("max batch items must be positive, got %d", n)
+	}
+	if n := config.GetInt64(config.MaxBatchBodyByte); n < 1 {
+		return fmt.Errorf("max batch body size must be positive, got %d", n)
+	}
+	if n := config.GetInt(config.BatchTimeoutSec); n < 0 {
+		return fmt.Errorf("batch timeout must not be negative, got %d", n)
+	}
+	return nil
+}
+
+//batchInput элемент пакета с его номером. Если строку ndjson не удалось разобрать, err не пустой
+type batchInput struct {
+	index int
+	item  batchItem
+	err   error
+}
+
+//readNDJSON читает элементы пакета построчно, пустые строки пропускаются
+func readNDJSON(r *http.Request, items chan<- batchInput) {
+	defer close(items)
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(nil, int(config.GetInt64(config.MaxImageSizeByte))*2)
+	var index int
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var item = batchInput{index: index}
+		item.err = json.Unmarshal(line, &item.item)
+		items <- item
+		index++
+	}
+	if err := scanner.Err(); err != nil {
+		items <- batchInput{index: index, err: err}
+	}
+}
+
+//processBatch обрабатывает элементы пакета не более чем в config.BatchConcurrency потоков
+func (router *Router) processBatch(r *http.Request, items <-chan batchInput, results chan<- batchResult) {
+	var wg sync.WaitGroup
+	var sem = make(chan struct{}, config.GetInt(config.BatchConcurrency))
+	for item := range items {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(item batchInput) {
+			defer wg.Done()
+			results <- router.processBatchItem(r, item)
+			<-sem
+		}(item)
+	}
+	wg.Wait()
+	close(results)
+}
+
+func (router *Router) processBatchItem(r *http.Request, item batchInput) batchResult {
+	var res = batchResult{
+		Index: item.index,
+		URL:   item.item.URL,
+	}
+	if item.err != nil {
+		res.Error = item.err.Error()
+		return res
+	}
+	if (item.item.URL == "") == (len(item.item.Image) == 0) {
+		res.Error = "Item must contain either 'url' or 'image'"
+		return res
+	}
+
+	variants, _, err := item.item.list()
+	if err == nil {
+		err = resizer.NormalizeVariants(variants)
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	negotiateFormats(variants, r)
+
+	//полоса элемента важнее полосы всего пакета из query
+	requested := item.item.Priority
+	if _, err := resizer.ParsePriority(string(requested)); err != nil {
+		res.Error = "Bad value of parameter 'priority': " + string(requested)
+		return res
+	}
+	if requested == "" {
+		requested = resizer.Priority(r.URL.Query().Get("priority"))
+	}
+	//элементы пакета ждут места в очереди, а не отклоняются как запросы клиентов
+	ctx := resizer.WithQueueWait(priorityContext(r, requested, resizer.Priority(config.GetString(config.BatchPriority))))
+
+	if item.item.URL != "" {
+		res.Results, err = router.Resizer.FromUrl(ctx, item.item.URL, variants)
+	} else {
+		res.Results, err = router.Resizer.ResizeImg(ctx, item.item.Image, variants)
+	}
+	if err != nil {
+		res.Results = nil
+		res.Error = err.Error()
+	}
+	return res
+}
+
+//batchDeadlines заменяет серверные таймауты чтения и записи на config.BatchTimeoutSec:
+//большой пакет или длинный поток ndjson не должен обрываться на середине.
+//Для входящего ndjson включает одновременное чтение запроса и запись ответа и возвращает, удалось ли
+func batchDeadlines(w http.ResponseWriter, ndjson bool) bool {
+	rc := http.NewResponseController(w)
+	var deadline time.Time
+	if timeout := config.GetInt(config.BatchTimeoutSec); timeout > 0 {
+		deadline = time.Now().Add(time.Duration(timeout) * time.Second)
+	}
+	rc.SetReadDeadline(deadline)
+	rc.SetWriteDeadline(deadline)
+	return ndjson && rc.EnableFullDuplex() == nil
+}
+
+//writeBatchNDJSON пишет и сразу отправляет каждый результат, как только элемент обработан.
+//Без duplex готовые результаты копятся, пока тело запроса не прочитано:
+//HTTP/1.1 сервер иначе не позволяет читать запрос после начала ответа
+func writeBatchNDJSON(w http.ResponseWriter, results <-chan batchResult, inputDone <-chan struct{}, duplex bool) {
+	var pending []batchResult
+	for waiting := !duplex; waiting; {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				waiting = false
+				break
+			}
+			pending = append(pending, res)
+		case <-inputDone:
+			waiting = false
+		}
+	}
+
+	w.Header().Set("Content-Type", ndjsonMimeType)
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	rc.Flush()
+	encoder := json.NewEncoder(w)
+	for _, res := range pending {
+		encoder.Encode(res)
+	}
+	rc.Flush()
+	for res := range results {
+		encoder.Encode(res)
+		rc.Flush()
+	}
+}
@@ -0,0 +1,73 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const jobsPath = "/jobs/"
+
+var jobIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+//jobs состояние асинхронных задач: GET /jobs/{id}
+func (router *Router) jobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("The path with this method is missing."))
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, jobsPath)
+	if !jobIDRe.MatchString(id) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Bad job id"))
+		return
+	}
+
+	job, ok := router.Resizer.Job(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Job not found"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job)
+}
+
+//writeAccepted отвечает 202 с ID поставленной асинхронной задачи или ошибкой постановки в очередь,
+//например 503 с Retry-After при заполненной очереди
+func writeAccepted(w http.ResponseWriter, id string, err error) {
+	if err != nil {
+		writeResizeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", jobsPath+id)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}{
+		ID:     id,
+		Status: "queued",
+	})
+}
+
+//checkCallbackURL проверяет, что адрес callback абсолютный http или https
+func checkCallbackURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Bad value of parameter 'callback_url': %s", raw)
+	}
+	return nil
+}
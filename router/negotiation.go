@@ -0,0 +1,77 @@
+package router
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"staply_img_resizer/resizer"
+	"strconv"
+	"strings"
+)
+
+//negotiatedFormats форматы, которые сервис выбирает по Accept, в порядке предпочтения
+var negotiatedFormats = []struct {
+	format    resizer.Format
+	mediaType string
+}{
+	{resizer.FormatAVIF, "image/avif"},
+	{resizer.FormatWEBP, "image/webp"},
+}
+
+//acceptedFormats возвращает форматы из negotiatedFormats, которые принимает клиент
+func acceptedFormats(accept string) []resizer.Format {
+	var accepted = make(map[string]bool)
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(q, 64); err != nil || v <= 0 {
+				continue
+			}
+		}
+		accepted[mt] = true
+	}
+
+	var formats []resizer.Format
+	for _, f := range negotiatedFormats {
+		if accepted[f.mediaType] {
+			formats = append(formats, f.format)
+		}
+	}
+	return formats
+}
+
+//negotiateFormats передаёт вариантам с форматом auto форматы из заголовка Accept.
+//Возвращает true, если формат хотя бы одного варианта зависит от Accept
+func negotiateFormats(variants []resizer.Options, r *http.Request) bool {
+	var auto bool
+	formats := acceptedFormats(r.Header.Get("Accept"))
+	for i := range variants {
+		if variants[i].Format == resizer.FormatAuto {
+			variants[i].Accept = formats
+			auto = true
+		}
+	}
+	return auto
+}
+
+//pickByAccept выбирает из файлов одной миниатюры в разных форматах
+//наиболее предпочтительный для клиента
+func pickByAccept(names []string, accept string) string {
+	for _, f := range acceptedFormats(accept) {
+		for _, name := range names {
+			if strings.TrimPrefix(path.Ext(name), ".") == string(f) {
+				return name
+			}
+		}
+	}
+	for _, name := range names {
+		switch path.Ext(name) {
+		case ".jpeg", ".png":
+			return name
+		}
+	}
+	return names[0]
+}
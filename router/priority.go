@@ -0,0 +1,60 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"staply_img_resizer/config"
+	"staply_img_resizer/resizer"
+	"strings"
+)
+
+//apiKeyHeader заголовок с ключом клиента для config.PriorityAPIKeys
+const apiKeyHeader = "X-API-Key"
+
+//priorityAPIKeys разбирает config.PriorityAPIKeys вида "key1=bulk;key2=interactive"
+func priorityAPIKeys() (map[string]resizer.Priority, error) {
+	var keys = make(map[string]resizer.Priority)
+	for _, pair := range strings.Split(config.GetString(config.PriorityAPIKeys), ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("bad priority api key '%s'", pair)
+		}
+		p, err := resizer.ParsePriority(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, err
+		}
+		keys[strings.TrimSpace(kv[0])] = p
+	}
+	return keys, nil
+}
+
+//CheckPriority проверяет настройки полос клиентов и пакетных запросов
+func CheckPriority() error {
+	if _, err := priorityAPIKeys(); err != nil {
+		return err
+	}
+	_, err := resizer.ParsePriority(config.GetString(config.BatchPriority))
+	return err
+}
+
+//requestPriority полоса запроса: по ключу клиента, иначе указанная в запросе, иначе def
+func requestPriority(r *http.Request, requested resizer.Priority, def resizer.Priority) resizer.Priority {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		if keys, err := priorityAPIKeys(); err == nil && keys[key] != "" {
+			return keys[key]
+		}
+	}
+	if requested != "" {
+		return requested
+	}
+	return def
+}
+
+//priorityContext контекст запроса с полосой из requestPriority
+func priorityContext(r *http.Request, requested resizer.Priority, def resizer.Priority) context.Context {
+	return resizer.WithPriority(r.Context(), requestPriority(r, requested, def))
+}
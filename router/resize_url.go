@@ -0,0 +1,195 @@
+package router
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"staply_img_resizer/config"
+	"staply_img_resizer/resizer"
+	"staply_img_resizer/storage"
+	"strconv"
+	"strings"
+)
+
+//resizePath путь для ресайза по подписанной ссылке вида /resize/{signature}/{options}/{encoded-source-url}
+//options: параметры миниатюры через запятую, например width:320,height:200,mode:fit,format:webp
+//encoded-source-url: url исходного изображения в base64 url-safe без паддинга
+//signature: HMAC-SHA256 от salt + "/{options}/{encoded-source-url}" в base64 url-safe без паддинга
+const resizePath = "/resize/"
+
+func (router *Router) resizeByURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("The path with this method is missing."))
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, resizePath), "/", 3)
+	if len(parts) != 3 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Bad resize path"))
+		return
+	}
+	signature, options, source := parts[0], parts[1], parts[2]
+
+	if err := checkSignature(signature, "/"+options+"/"+source); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	srcURL, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(source, "="))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Bad encoded source url"))
+		return
+	}
+
+	opts, err := resizeURLOptions(options)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if negotiateFormats(opts, r) {
+		w.Header().Set("Vary", "Accept")
+	}
+
+	var id string
+	if config.GetBool(config.ResizeURLCache) {
+		id = resizeCacheID(options, source, opts[0].Accept)
+		if name, err := findThumbnail(r.Context(), router.Storage, router.Layout, id, ""); err == nil {
+			router.serveThumbnailFile(w, r, name)
+			return
+		}
+	}
+
+	//HEAD не загружает исходник и не рендерит миниатюру: ответ строится по её параметрам,
+	//а тип содержимого указывается, только если формат известен заранее.
+	//Поэтому 200 означает, что ссылка подписана и параметры верны, но не то, что исходник доступен
+	if r.Method == http.MethodHead {
+		if f := opts[0].FixedFormat(); f != "" {
+			w.Header().Set("Content-Type", mime.TypeByExtension("."+string(f)))
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	res, err := router.Resizer.RenderUrl(priorityContext(r, "", resizer.PriorityInteractive), string(srcURL), opts[0], id)
+	if err != nil {
+		writeResizeError(w, err)
+		return
+	}
+
+	if ct := mime.TypeByExtension(res.Extension); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(res.Data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(res.Data)
+}
+
+//CheckResizeURL проверяет, что кэш ресайза по ссылке можно найти в хранилище.
+//Миниатюра из кэша ищется по ID, поэтому путь в шаблоне должен определяться только ID и расширением
+func CheckResizeURL(layout *storage.Layout) error {
+	if config.GetBool(config.ResizeURLCache) && !layout.Resolvable() {
+		return fmt.Errorf("resize url cache needs a storage layout that depends only on {id} and {shard}")
+	}
+	return nil
+}
+
+//resizeURLOptions разбирает и нормализует параметры миниатюры из пути
+func resizeURLOptions(options string) ([]resizer.Options, error) {
+	var values = make(map[string]string)
+	for _, opt := range strings.Split(options, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Bad option '%s'", opt)
+		}
+		values[kv[0]] = kv[1]
+	}
+
+	req, err := variantsFromValues(func(name string) string {
+		return values[name]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	variants, multi, err := req.list()
+	if err != nil {
+		return nil, err
+	}
+	if multi {
+		return nil, fmt.Errorf("Only one thumbnail can be rendered by url")
+	}
+	return variants, resizer.NormalizeVariants(variants)
+}
+
+//checkSignature проверяет подпись пути любым из ключей config.ResizeURLKeys
+func checkSignature(signature string, path string) error {
+	keys, salt, err := signingKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("Signing keys are not configured")
+	}
+
+	sign, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(signature, "="))
+	if err != nil {
+		return fmt.Errorf("Bad signature")
+	}
+
+	for _, key := range keys {
+		if hmac.Equal(sign, signPath(key, salt, path)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Bad signature")
+}
+
+//signingKeys ключи и соль для подписи в hex из конфига.
+//Ключей может быть несколько через запятую, чтобы их можно было менять без простоя
+func signingKeys() ([][]byte, []byte, error) {
+	var keys [][]byte
+	for _, k := range strings.Split(config.GetString(config.ResizeURLKeys), ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		key, err := hex.DecodeString(k)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Bad signing key in config")
+		}
+		keys = append(keys, key)
+	}
+
+	salt, err := hex.DecodeString(config.GetString(config.ResizeURLSalt))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Bad signing salt in config")
+	}
+	return keys, salt, nil
+}
+
+func signPath(key []byte, salt []byte, path string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	mac.Write([]byte(path))
+	return mac.Sum(nil)
+}
+
+//resizeCacheID ID, под которым результат ресайза по ссылке сохраняется как кэш.
+//Для формата auto учитываются форматы, которые принимает клиент
+func resizeCacheID(options string, source string, accept []resizer.Format) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s/%s/%v", options, source, accept)
+	return "r" + hex.EncodeToString(h.Sum(nil))[:40]
+}
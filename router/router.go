@@ -2,25 +2,53 @@ package router
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"mime"
 	"net/http"
 	"staply_img_resizer/config"
 	"staply_img_resizer/resizer"
+	"staply_img_resizer/storage"
 	"strconv"
+	"strings"
 )
 
 type Router struct {
 	Resizer resizer.Resizer
+	//Storage хранилище, из которого отдаются сохранённые миниатюры
+	Storage storage.Storage
+	//Layout раскладка файлов в хранилище
+	Layout *storage.Layout
 }
 
-func NewRouter(r resizer.Resizer) Router {
+func NewRouter(r resizer.Resizer, s storage.Storage, l *storage.Layout) Router {
 	return Router{
 		Resizer: r,
+		Storage: s,
+		Layout:  l,
 	}
 }
 
 func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path+"/", thumbnailsPath):
+		router.thumbnails(w, r)
+	case strings.HasPrefix(r.URL.Path, resizePath):
+		router.resizeByURL(w, r)
+	case strings.HasPrefix(r.URL.Path, jobsPath):
+		router.jobs(w, r)
+	case r.URL.Path == batchPath:
+		router.batch(w, r)
+	case r.URL.Path == workersPath:
+		router.workers(w, r)
+	default:
+		router.images(w, r)
+	}
+}
+
+//images создание миниатюр. Путь не учитывается
+func (router *Router) images(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		router.imgFromUrl(w, r)
@@ -64,14 +92,40 @@ func (router *Router) imgFromUrl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := router.Resizer.FromUrl(urlVal)
+	req, err := variantsFromValues(keys.Get)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	variants, multi, err := req.list()
+	if err == nil {
+		err = resizer.NormalizeVariants(variants)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if negotiateFormats(variants, r) {
+		w.Header().Set("Vary", "Accept")
+	}
+
+	ctx := priorityContext(r, req.Priority, resizer.PriorityInteractive)
+	if req.Async || req.CallbackURL != "" {
+		id, err := router.Resizer.SubmitUrl(ctx, urlVal, variants, req.CallbackURL)
+		writeAccepted(w, id, err)
+		return
+	}
+
+	res, err := router.Resizer.FromUrl(ctx, urlVal, variants)
+	if err != nil {
+		writeResizeError(w, err)
+		return
+	}
+
+	writeResults(w, res, multi)
 }
 
 func (router *Router) imgFromMultiPart(w http.ResponseWriter, r *http.Request) {
@@ -91,19 +145,46 @@ func (router *Router) imgFromMultiPart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = router.Resizer.ResizeImg(img)
+	req, err := variantsFromValues(r.FormValue)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	variants, multi, err := req.list()
+	if err == nil {
+		err = resizer.NormalizeVariants(variants)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if negotiateFormats(variants, r) {
+		w.Header().Set("Vary", "Accept")
+	}
+
+	ctx := priorityContext(r, req.Priority, resizer.PriorityInteractive)
+	if req.Async || req.CallbackURL != "" {
+		id, err := router.Resizer.SubmitImg(ctx, img, variants, req.CallbackURL)
+		writeAccepted(w, id, err)
+		return
+	}
+
+	res, err := router.Resizer.ResizeImg(ctx, img, variants)
+	if err != nil {
+		writeResizeError(w, err)
+		return
+	}
+
+	writeResults(w, res, multi)
 }
 
 func (router *Router) imgFromJson(w http.ResponseWriter, r *http.Request) {
 	var jsonImage struct {
 		Image []byte `json:"image"`
+		variantsRequest
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -122,12 +203,196 @@ func (router *Router) imgFromJson(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = router.Resizer.ResizeImg(jsonImage.Image)
+	if err = checkCallbackURL(jsonImage.CallbackURL); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	variants, multi, err := jsonImage.list()
+	if err == nil {
+		err = resizer.NormalizeVariants(variants)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if negotiateFormats(variants, r) {
+		w.Header().Set("Vary", "Accept")
+	}
+
+	if _, err = resizer.ParsePriority(string(jsonImage.Priority)); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Bad value of parameter 'priority': %s", jsonImage.Priority)))
+		return
+	}
+
+	ctx := priorityContext(r, jsonImage.Priority, resizer.PriorityInteractive)
+	if jsonImage.Async || jsonImage.CallbackURL != "" {
+		id, err := router.Resizer.SubmitImg(ctx, jsonImage.Image, variants, jsonImage.CallbackURL)
+		writeAccepted(w, id, err)
+		return
+	}
+
+	res, err := router.Resizer.ResizeImg(ctx, jsonImage.Image, variants)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeResizeError(w, err)
+		return
+	}
+
+	writeResults(w, res, multi)
+}
+
+//variantsRequest параметры миниатюр из запроса: одна миниатюра
+//или несколько вариантов по списку ширин, пресетов или явных параметров.
+//Async ставит асинхронную задачу вместо ожидания результата, CallbackURL делает то же самое
+//и по завершении задачи отправляет её результат на указанный адрес.
+//Priority полоса пайплайна, ключ клиента из config.PriorityAPIKeys её переопределяет
+type variantsRequest struct {
+	resizer.Options
+	Widths      []int             `json:"widths"`
+	Presets     []string          `json:"presets"`
+	Variants    []resizer.Options `json:"variants"`
+	Async       bool              `json:"async"`
+	CallbackURL string            `json:"callback_url"`
+	Priority    resizer.Priority  `json:"priority"`
+}
+
+//list возвращает параметры всех вариантов и признак того, что запрошен список вариантов.
+//Варианты по ширинам получили бы имя общего пресета, поэтому widths нельзя сочетать с preset
+func (v variantsRequest) list() ([]resizer.Options, bool, error) {
+	if len(v.Widths) > 0 && v.Preset != "" {
+		return nil, false, fmt.Errorf("Parameters 'widths' and 'preset' can't be used together, use 'presets'")
+	}
+
+	var variants []resizer.Options
+	for _, width := range v.Widths {
+		opts := v.Options
+		opts.Width = width
+		variants = append(variants, opts)
+	}
+	for _, preset := range v.Presets {
+		variants = append(variants, resizer.Options{Preset: preset})
+	}
+	variants = append(variants, v.Variants...)
+
+	if len(variants) == 0 {
+		return []resizer.Options{v.Options}, false, nil
+	}
+	for i := range variants {
+		if variants[i].Tenant == "" {
+			variants[i].Tenant = v.Tenant
+		}
+		if variants[i].Original == "" {
+			variants[i].Original = v.Original
+		}
+	}
+	return variants, true, nil
+}
+
+//variantsFromValues собирает параметры миниатюр из query или полей формы.
+//Списки ширин и пресетов передаются через запятую
+func variantsFromValues(get func(string) string) (variantsRequest, error) {
+	var req = variantsRequest{
+		Options: resizer.Options{
+			Preset:   get("preset"),
+			Mode:     resizer.ResizeMode(get("mode")),
+			Format:   resizer.Format(get("format")),
+			Tenant:   get("tenant"),
+			Original: resizer.OriginalMode(get("original")),
+		},
+	}
+
+	var err error
+	for _, p := range []struct {
+		name string
+		val  *int
+	}{
+		{"width", &req.Width},
+		{"height", &req.Height},
+		{"quality", &req.Quality},
+		{"compression", &req.Compression},
+	} {
+		if v := get(p.name); v != "" {
+			if *p.val, err = strconv.Atoi(v); err != nil {
+				return req, fmt.Errorf("Bad value of parameter '%s': %s", p.name, v)
+			}
+		}
+	}
+	for _, p := range []struct {
+		name string
+		val  *bool
+	}{
+		{"progressive", &req.Progressive},
+		{"lossless", &req.Lossless},
+		{"async", &req.Async},
+	} {
+		if v := get(p.name); v != "" {
+			if *p.val, err = strconv.ParseBool(v); err != nil {
+				return req, fmt.Errorf("Bad value of parameter '%s': %s", p.name, v)
+			}
+		}
+	}
+	if v := get("widths"); v != "" {
+		for _, w := range strings.Split(v, ",") {
+			width, err := strconv.Atoi(strings.TrimSpace(w))
+			if err != nil {
+				return req, fmt.Errorf("Bad value of parameter 'widths': %s", v)
+			}
+			req.Widths = append(req.Widths, width)
+		}
+	}
+	if v := get("presets"); v != "" {
+		for _, p := range strings.Split(v, ",") {
+			req.Presets = append(req.Presets, strings.TrimSpace(p))
+		}
+	}
+	if req.Priority, err = resizer.ParsePriority(get("priority")); err != nil {
+		return req, fmt.Errorf("Bad value of parameter 'priority': %s", get("priority"))
+	}
+	req.CallbackURL = get("callback_url")
+	if err = checkCallbackURL(req.CallbackURL); err != nil {
+		return req, err
+	}
+
+	return req, nil
+}
+
+//writeResizeError отвечает ошибкой ресайза. Если очередь пайплайна заполнена, отвечает
+//config.QueueFullStatus с Retry-After, чтобы балансировщик отправил запрос на другую реплику,
+//а во время остановки сервиса - 503
+func writeResizeError(w http.ResponseWriter, err error) {
+	if qf, ok := err.(*resizer.QueueFullError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(qf.RetryAfter.Seconds()))))
+		w.WriteHeader(config.GetInt(config.QueueFullStatus))
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err == resizer.ErrStopped {
+		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Write([]byte(err.Error()))
 		return
 	}
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(err.Error()))
+}
 
+//writeResults отвечает описанием одной миниатюры или, если запрошен список вариантов
+//или вместе с миниатюрой сохранён исходник, их общим ID и списком вариантов
+func writeResults(w http.ResponseWriter, res []*resizer.Result, multi bool) {
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	if !multi && len(res) == 1 {
+		json.NewEncoder(w).Encode(res[0])
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		ID       string            `json:"id"`
+		Variants []*resizer.Result `json:"variants"`
+	}{
+		ID:       res[0].BaseID,
+		Variants: res,
+	})
 }
@@ -2,6 +2,7 @@ package router
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -10,24 +11,104 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"staply_img_resizer/config"
+	"staply_img_resizer/resizer"
+	"staply_img_resizer/storage"
+	"strings"
 	"testing"
+	"time"
 )
 
 type ResizerMock struct {
-	Err     error
-	Entered string
+	Res         *resizer.Result
+	Err         error
+	Entered     string
+	EnteredOpts []resizer.Options
+	EnteredID   string
+	JobID       string
+	JobStatus   *resizer.JobStatus
+	Callback    string
+	Priority    resizer.Priority
+	Pools       []resizer.PoolStatus
 }
 
-func (r *ResizerMock) FromUrl(url string) error {
+func (r *ResizerMock) FromUrl(ctx context.Context, url string, variants []resizer.Options) ([]*resizer.Result, error) {
+	r.Priority = resizer.PriorityFrom(ctx)
 	r.Entered = url
-	return r.Err
+	r.EnteredOpts = variants
+	return r.results(variants), r.Err
 }
 
-func (r *ResizerMock) ResizeImg(img []byte) error {
+func (r *ResizerMock) ResizeImg(ctx context.Context, img []byte, variants []resizer.Options) ([]*resizer.Result, error) {
+	r.Priority = resizer.PriorityFrom(ctx)
 	r.Entered = string(img)
-	return r.Err
+	r.EnteredOpts = variants
+	return r.results(variants), r.Err
 }
 
+func (r *ResizerMock) RenderUrl(ctx context.Context, url string, opts resizer.Options, id string) (*resizer.Result, error) {
+	r.Priority = resizer.PriorityFrom(ctx)
+	r.Entered = url
+	r.EnteredOpts = []resizer.Options{opts}
+	r.EnteredID = id
+	return r.Res, r.Err
+}
+
+func (r *ResizerMock) SubmitUrl(ctx context.Context, url string, variants []resizer.Options, callbackURL string) (string, error) {
+	r.Priority = resizer.PriorityFrom(ctx)
+	r.Entered = url
+	r.EnteredOpts = variants
+	r.Callback = callbackURL
+	return r.JobID, r.Err
+}
+
+func (r *ResizerMock) SubmitImg(ctx context.Context, img []byte, variants []resizer.Options, callbackURL string) (string, error) {
+	r.Priority = resizer.PriorityFrom(ctx)
+	r.Entered = string(img)
+	r.EnteredOpts = variants
+	r.Callback = callbackURL
+	return r.JobID, r.Err
+}
+
+func (r *ResizerMock) Workers() []resizer.PoolStatus {
+	return r.Pools
+}
+
+func (r *ResizerMock) Job(id string) (resizer.JobStatus, bool) {
+	if r.JobStatus == nil || r.JobStatus.ID != id {
+		return resizer.JobStatus{}, false
+	}
+	return *r.JobStatus, true
+}
+
+func (r *ResizerMock) results(variants []resizer.Options) []*resizer.Result {
+	var res = make([]*resizer.Result, len(variants))
+	for i := range res {
+		res[i] = r.Res
+	}
+	//сохранённый исходник возвращается отдельным вариантом
+	if len(variants) > 0 && (variants[0].Original == resizer.OriginalSource || variants[0].Original == resizer.OriginalMaster) {
+		res = append(res, r.Res)
+	}
+	return res
+}
+
+var testResult = &resizer.Result{
+	ID:        "some-id",
+	BaseID:    "some-id",
+	Extension: ".jpeg",
+	Size:      42,
+	Width:     100,
+	Height:    100,
+}
+
+var flatLayout, _ = storage.NewLayout(storage.LayoutFlat)
+
+const testResultJSON = `{"id":"some-id","base_id":"some-id","extension":".jpeg","size":42,"width":100,"height":100}` + "\n"
+
 func TestRouterGet(t *testing.T) {
 	testCases := []struct {
 		URLValues          url.Values
@@ -38,9 +119,10 @@ func TestRouterGet(t *testing.T) {
 	}{
 		{
 			URLValues:          createVals("url", "someUrl"),
-			Resizer:            ResizerMock{},
+			Resizer:            ResizerMock{Res: testResult},
 			ExpectedStatusCode: http.StatusOK,
 			ExpectedEnter:      "someUrl",
+			ExpectedBody:       testResultJSON,
 		},
 		{
 			URLValues:          url.Values{},
@@ -63,7 +145,7 @@ func TestRouterGet(t *testing.T) {
 		v := tCase.URLValues.Encode()
 		u, _ := url.Parse("https://example.org?" + v)
 		req := httptest.NewRequest(http.MethodGet, u.String(), nil)
-		router := NewRouter(&tCase.Resizer)
+		router := NewRouter(&tCase.Resizer, storage.NewMemory(), flatLayout)
 		w := httptest.NewRecorder()
 
 		router.ServeHTTP(w, req)
@@ -95,9 +177,10 @@ func TestMultiPartFormImg(t *testing.T) {
 		{
 			fieldName:          "image",
 			fileVal:            "some bytes",
-			Resizer:            ResizerMock{},
+			Resizer:            ResizerMock{Res: testResult},
 			ExpectedStatusCode: http.StatusOK,
 			ExpectedEnter:      "some bytes",
+			ExpectedBody:       testResultJSON,
 		},
 		{
 			fieldName:          "noImage",
@@ -131,7 +214,7 @@ func TestMultiPartFormImg(t *testing.T) {
 
 		req.Header.Set("Content-Type",
 			bodyWriter.FormDataContentType())
-		router := NewRouter(&tCase.Resizer)
+		router := NewRouter(&tCase.Resizer, storage.NewMemory(), flatLayout)
 		w := httptest.NewRecorder()
 
 		err := bodyWriter.Close()
@@ -168,9 +251,10 @@ func TestJSONImg(t *testing.T) {
 		{
 			fieldName:          "image",
 			fieldVal:           "some bytes",
-			Resizer:            ResizerMock{},
+			Resizer:            ResizerMock{Res: testResult},
 			ExpectedStatusCode: http.StatusOK,
 			ExpectedEnter:      "some bytes",
+			ExpectedBody:       testResultJSON,
 		},
 		{
 			fieldName:          "anotherField",
@@ -201,7 +285,7 @@ func TestJSONImg(t *testing.T) {
 			bytes.NewReader(jsonVal),
 		)
 		req.Header.Set("Content-Type", "application/json")
-		router := NewRouter(&tCase.Resizer)
+		router := NewRouter(&tCase.Resizer, storage.NewMemory(), flatLayout)
 		w := httptest.NewRecorder()
 
 		router.ServeHTTP(w, req)
@@ -221,36 +305,1437 @@ func TestJSONImg(t *testing.T) {
 	}
 }
 
-func createVals(name string, vals ...string) url.Values {
-	var urlVals = url.Values{}
-	for _, v := range vals {
-		urlVals.Add(name, v)
+func TestResizeOptions(t *testing.T) {
+	defaultOpts := []resizer.Options{{Width: 100, Height: 100, Mode: resizer.ModeCrop}}
+
+	testCases := []struct {
+		Request            func() *http.Request
+		ExpectedStatusCode int
+		ExpectedOpts       []resizer.Options
+		ExpectedBody       string
+		ExpectedVary       string
+	}{
+		{
+			Request:            getRequest(createVals("url", "someUrl")),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts:       defaultOpts,
+		},
+		{
+			Request: getRequest(url.Values{
+				"url":    {"someUrl"},
+				"width":  {"320"},
+				"height": {"200"},
+				"mode":   {"fit"},
+			}),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts:       []resizer.Options{{Width: 320, Height: 200, Mode: resizer.ModeFit}},
+		},
+		{
+			Request: getRequest(url.Values{
+				"url":   {"someUrl"},
+				"width": {"64"},
+			}),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts:       []resizer.Options{{Width: 64, Height: 64, Mode: resizer.ModeCrop}},
+		},
+		{
+			Request: getRequest(url.Values{
+				"url":   {"someUrl"},
+				"width": {"wide"},
+			}),
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Bad value of parameter 'width': wide",
+		},
+		{
+			Request: getRequest(url.Values{
+				"url":    {"someUrl"},
+				"height": {"100000"},
+			}),
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "thumbnail size 100000x100000 is out of bounds [16, 2048]",
+		},
+		{
+			Request: getRequest(url.Values{
+				"url":  {"someUrl"},
+				"mode": {"zoom"},
+			}),
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "unknown resize mode 'zoom'",
+		},
+		{
+			Request: func() *http.Request {
+				b, bodyWriter := multipartBody("image", "some bytes")
+				bodyWriter.WriteField("width", "64")
+				bodyWriter.WriteField("mode", "pad")
+				bodyWriter.Close()
+				req := httptest.NewRequest(http.MethodPost, "https://example.org", b)
+				req.Header.Set("Content-Type", bodyWriter.FormDataContentType())
+				return req
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts:       []resizer.Options{{Width: 64, Height: 64, Mode: resizer.ModePad}},
+		},
+		{
+			Request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "https://example.org",
+					bytes.NewReader([]byte(`{"image":"c29tZQ==","width":128,"height":96,"mode":"stretch"}`)))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts:       []resizer.Options{{Width: 128, Height: 96, Mode: resizer.ModeStretch}},
+		},
+		{
+			Request: getRequest(url.Values{
+				"url":    {"someUrl"},
+				"widths": {"64, 128"},
+				"mode":   {"fit"},
+			}),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts: []resizer.Options{
+				{Width: 64, Height: 64, Mode: resizer.ModeFit},
+				{Width: 128, Height: 128, Mode: resizer.ModeFit},
+			},
+			ExpectedBody: `{"id":"some-id","variants":[` + testResultJSON[:len(testResultJSON)-1] + "," +
+				testResultJSON[:len(testResultJSON)-1] + "]}\n",
+		},
+		{
+			Request: getRequest(url.Values{
+				"url":      {"someUrl"},
+				"width":    {"64"},
+				"original": {"master"},
+			}),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts:       []resizer.Options{{Width: 64, Height: 64, Mode: resizer.ModeCrop, Original: resizer.OriginalMaster}},
+			ExpectedBody: `{"id":"some-id","variants":[` + testResultJSON[:len(testResultJSON)-1] + "," +
+				testResultJSON[:len(testResultJSON)-1] + "]}\n",
+		},
+		{
+			Request: getRequest(url.Values{
+				"url":      {"someUrl"},
+				"format":   {"webp"},
+				"quality":  {"80"},
+				"lossless": {"true"},
+			}),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts: []resizer.Options{
+				{Width: 100, Height: 100, Mode: resizer.ModeCrop, Format: resizer.FormatWEBP, Quality: 80, Lossless: true},
+			},
+		},
+		{
+			Request: getRequest(url.Values{
+				"url":         {"someUrl"},
+				"format":      {"png"},
+				"compression": {"9"},
+				"progressive": {"1"},
+			}),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts: []resizer.Options{
+				{Width: 100, Height: 100, Mode: resizer.ModeCrop, Format: resizer.FormatPNG, Compression: 9, Progressive: true},
+			},
+		},
+		{
+			Request: func() *http.Request {
+				req := getRequest(url.Values{"url": {"someUrl"}, "format": {"auto"}})()
+				req.Header.Set("Accept", "image/avif;q=0,image/webp,image/*;q=0.8")
+				return req
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts: []resizer.Options{
+				{Width: 100, Height: 100, Mode: resizer.ModeCrop, Format: resizer.FormatAuto, Accept: []resizer.Format{resizer.FormatWEBP}},
+			},
+			ExpectedVary: "Accept",
+		},
+		{
+			Request: getRequest(url.Values{
+				"url":    {"someUrl"},
+				"format": {"avif"},
+			}),
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "format 'avif' is not supported by vips",
+		},
+		{
+			Request: getRequest(url.Values{
+				"url":      {"someUrl"},
+				"format":   {"jpeg"},
+				"lossless": {"true"},
+			}),
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "lossless is supported only for webp",
+		},
+		{
+			Request: getRequest(url.Values{
+				"url":     {"someUrl"},
+				"quality": {"high"},
+			}),
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Bad value of parameter 'quality': high",
+		},
+		{
+			Request: getRequest(url.Values{
+				"url":    {"someUrl"},
+				"widths": {"64,64"},
+			}),
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "duplicate thumbnail variant '64x64_crop'",
+		},
+		{
+			Request: getRequest(url.Values{
+				"url":    {"someUrl"},
+				"widths": {"64,big"},
+			}),
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Bad value of parameter 'widths': 64,big",
+		},
+		{
+			Request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "https://example.org",
+					bytes.NewReader([]byte(`{"image":"c29tZQ==","variants":[{"width":32},{"width":48,"mode":"pad"}]}`)))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts: []resizer.Options{
+				{Width: 32, Height: 32, Mode: resizer.ModeCrop},
+				{Width: 48, Height: 48, Mode: resizer.ModePad},
+			},
+		},
+		{
+			Request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "https://example.org",
+					bytes.NewReader([]byte(`{"image":"c29tZQ==","width":1}`)))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "thumbnail size 1x1 is out of bounds [16, 2048]",
+		},
+	}
+
+	for i, tCase := range testCases {
+		resizerMock := ResizerMock{Res: testResult}
+		router := NewRouter(&resizerMock, storage.NewMemory(), flatLayout)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, tCase.Request())
+
+		if w.Code != tCase.ExpectedStatusCode {
+			t.Errorf("Case %v. Bad status code. Expected '%v', got '%v'", i, tCase.ExpectedStatusCode, w.Code)
+		}
+
+		if tCase.ExpectedBody != "" && w.Body.String() != tCase.ExpectedBody {
+			t.Errorf("Case %v. Bad body value. Expected '%v', got '%v'", i, tCase.ExpectedBody, w.Body.String())
+		}
+
+		if !reflect.DeepEqual(resizerMock.EnteredOpts, tCase.ExpectedOpts) {
+			t.Errorf("Case %v. Bad options entered to resizer method. Expected '%+v', got '%+v'", i, tCase.ExpectedOpts, resizerMock.EnteredOpts)
+		}
+
+		if vary := w.Header().Get("Vary"); vary != tCase.ExpectedVary {
+			t.Errorf("Case %v. Bad Vary header. Expected '%v', got '%v'", i, tCase.ExpectedVary, vary)
+		}
 	}
-	return urlVals
 }
 
-func multipartBody(formName string, val string) (*bytes.Buffer, *multipart.Writer) {
-	bodyBuf := &bytes.Buffer{}
-	bodyWriter := multipart.NewWriter(bodyBuf)
+func TestAcceptedFormats(t *testing.T) {
+	testCases := []struct {
+		Accept          string
+		ExpectedFormats []resizer.Format
+	}{
+		{
+			Accept: "",
+		},
+		{
+			Accept: "image/png,image/*;q=0.8",
+		},
+		{
+			Accept:          "image/webp,*/*",
+			ExpectedFormats: []resizer.Format{resizer.FormatWEBP},
+		},
+		{
+			Accept:          "image/webp, image/avif;q=0.9",
+			ExpectedFormats: []resizer.Format{resizer.FormatAVIF, resizer.FormatWEBP},
+		},
+		{
+			Accept:          "image/avif;q=0, image/webp;q=0.5",
+			ExpectedFormats: []resizer.Format{resizer.FormatWEBP},
+		},
+	}
 
-	fileWriter, err := bodyWriter.CreateFormFile(formName, "filename.jpeg")
-	if err != nil {
-		fmt.Print(err.Error())
+	for _, tCase := range testCases {
+		formats := acceptedFormats(tCase.Accept)
+		if !reflect.DeepEqual(formats, tCase.ExpectedFormats) {
+			t.Errorf("Bad formats for '%v'. Expected '%v', got '%v'", tCase.Accept, tCase.ExpectedFormats, formats)
+		}
 	}
+}
 
-	br := bytes.NewReader([]byte(val))
-	io.Copy(fileWriter, br)
+func TestPresets(t *testing.T) {
+	config.Set(config.Presets, "avatar=64x64 crop;card=320x200 fit")
+	defer config.Set(config.Presets, "")
+	defer config.Set(config.StrictPresets, false)
 
-	return bodyBuf, bodyWriter
+	testCases := []struct {
+		Strict             bool
+		URLValues          url.Values
+		ExpectedStatusCode int
+		ExpectedOpts       []resizer.Options
+		ExpectedBody       string
+	}{
+		{
+			URLValues:          url.Values{"url": {"someUrl"}, "preset": {"card"}},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts:       []resizer.Options{{Preset: "card", Width: 320, Height: 200, Mode: resizer.ModeFit}},
+		},
+		{
+			URLValues:          url.Values{"url": {"someUrl"}, "preset": {"avatar"}, "width": {"128"}},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts:       []resizer.Options{{Preset: "avatar", Width: 128, Height: 128, Mode: resizer.ModeCrop}},
+		},
+		{
+			URLValues:          url.Values{"url": {"someUrl"}, "preset": {"hero"}},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "unknown preset 'hero'",
+		},
+		{
+			URLValues:          url.Values{"url": {"someUrl"}, "presets": {"avatar,card"}},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts: []resizer.Options{
+				{Preset: "avatar", Width: 64, Height: 64, Mode: resizer.ModeCrop},
+				{Preset: "card", Width: 320, Height: 200, Mode: resizer.ModeFit},
+			},
+		},
+		{
+			Strict:             true,
+			URLValues:          url.Values{"url": {"someUrl"}, "preset": {"avatar"}},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts:       []resizer.Options{{Preset: "avatar", Width: 64, Height: 64, Mode: resizer.ModeCrop}},
+		},
+		{
+			Strict:             true,
+			URLValues:          url.Values{"url": {"someUrl"}, "preset": {"avatar"}, "width": {"128"}},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "only preset parameters are allowed",
+		},
+		{
+			Strict:             true,
+			URLValues:          url.Values{"url": {"someUrl"}, "width": {"128"}},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "parameter 'preset' is required",
+		},
+		{
+			Strict:             true,
+			URLValues:          url.Values{"url": {"someUrl"}, "preset": {"avatar"}, "format": {"auto"}},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOpts:       []resizer.Options{{Preset: "avatar", Width: 64, Height: 64, Mode: resizer.ModeCrop, Format: resizer.FormatAuto}},
+		},
+		{
+			Strict:             true,
+			URLValues:          url.Values{"url": {"someUrl"}, "preset": {"avatar"}, "format": {"webp"}},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "only preset parameters are allowed",
+		},
+		{
+			URLValues:          url.Values{"url": {"someUrl"}, "preset": {"card"}, "widths": {"320"}},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Parameters 'widths' and 'preset' can't be used together, use 'presets'",
+		},
+	}
+
+	for i, tCase := range testCases {
+		config.Set(config.StrictPresets, tCase.Strict)
+		resizerMock := ResizerMock{Res: testResult}
+		router := NewRouter(&resizerMock, storage.NewMemory(), flatLayout)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, getRequest(tCase.URLValues)())
+
+		if w.Code != tCase.ExpectedStatusCode {
+			t.Errorf("Case %v. Bad status code. Expected '%v', got '%v'", i, tCase.ExpectedStatusCode, w.Code)
+		}
+
+		if tCase.ExpectedBody != "" && w.Body.String() != tCase.ExpectedBody {
+			t.Errorf("Case %v. Bad body value. Expected '%v', got '%v'", i, tCase.ExpectedBody, w.Body.String())
+		}
+
+		if !reflect.DeepEqual(resizerMock.EnteredOpts, tCase.ExpectedOpts) {
+			t.Errorf("Case %v. Bad options entered to resizer method. Expected '%+v', got '%+v'", i, tCase.ExpectedOpts, resizerMock.EnteredOpts)
+		}
+	}
 }
 
-func jsonBody(formName string, val string) []byte {
-	jsonVal, err := json.Marshal(map[string]string{
-		formName: base64.StdEncoding.
-			EncodeToString([]byte(val)),
-	})
-	if err != nil {
-		fmt.Print(err.Error())
+func TestResizeByURL(t *testing.T) {
+	config.Set(config.ResizeURLKeys, "736563726574, 6e6577736563726574")
+	config.Set(config.ResizeURLSalt, "73616c74")
+	defer config.Set(config.ResizeURLKeys, "")
+	defer config.Set(config.ResizeURLSalt, "")
+	defer config.Set(config.ResizeURLCache, false)
+
+	source := base64.RawURLEncoding.EncodeToString([]byte("http://example.org/img.jpg"))
+	sign := func(key string, options string) string {
+		return "/resize/" + base64.RawURLEncoding.EncodeToString(
+			signPath([]byte(key), []byte("salt"), "/"+options+"/"+source)) +
+			"/" + options + "/" + source
+	}
+
+	rendered := &resizer.Result{
+		ID:        "rendered",
+		Extension: ".webp",
+		Data:      []byte("thumbnail bytes"),
+	}
+
+	testCases := []struct {
+		Method              string
+		Path                string
+		Cache               bool
+		Accept              string
+		Resizer             ResizerMock
+		ExpectedStatusCode  int
+		ExpectedContentType string
+		ExpectedBody        string
+		ExpectedEnter       string
+		ExpectedOpts        []resizer.Options
+		ExpectedID          string
+	}{
+		{
+			Path:                sign("secret", "width:320,height:200,mode:fit,format:webp"),
+			Resizer:             ResizerMock{Res: rendered},
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "image/webp",
+			ExpectedBody:        "thumbnail bytes",
+			ExpectedEnter:       "http://example.org/img.jpg",
+			ExpectedOpts: []resizer.Options{
+				{Width: 320, Height: 200, Mode: resizer.ModeFit, Format: resizer.FormatWEBP},
+			},
+		},
+		{
+			Path:                sign("newsecret", "width:64"),
+			Cache:               true,
+			Resizer:             ResizerMock{Res: rendered},
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "image/webp",
+			ExpectedBody:        "thumbnail bytes",
+			ExpectedEnter:       "http://example.org/img.jpg",
+			ExpectedOpts:        []resizer.Options{{Width: 64, Height: 64, Mode: resizer.ModeCrop}},
+			ExpectedID:          resizeCacheID("width:64", source, nil),
+		},
+		{
+			Path:                sign("secret", "width:128"),
+			Cache:               true,
+			Resizer:             ResizerMock{Res: rendered},
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "image/png",
+			ExpectedBody:        "cached bytes",
+		},
+		{
+			Method:              http.MethodHead,
+			Path:                sign("secret", "width:320,height:200,mode:fit,format:webp"),
+			Resizer:             ResizerMock{Res: rendered},
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "image/webp",
+		},
+		{
+			Method:              http.MethodHead,
+			Path:                sign("secret", "width:320,format:auto"),
+			Accept:              "image/webp",
+			Resizer:             ResizerMock{Res: rendered},
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "image/webp",
+		},
+		{
+			Method:              http.MethodHead,
+			Path:                sign("secret", "width:320"),
+			Resizer:             ResizerMock{Res: rendered},
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "-",
+		},
+		{
+			Method:              http.MethodHead,
+			Path:                sign("secret", "width:128"),
+			Cache:               true,
+			Resizer:             ResizerMock{Res: rendered},
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "image/png",
+		},
+		{
+			Path:               sign("wrong", "width:320"),
+			Resizer:            ResizerMock{Res: rendered},
+			ExpectedStatusCode: http.StatusForbidden,
+			ExpectedBody:       "Bad signature",
+		},
+		{
+			Path:               sign("secret", "width:320") + "x",
+			Resizer:            ResizerMock{Res: rendered},
+			ExpectedStatusCode: http.StatusForbidden,
+			ExpectedBody:       "Bad signature",
+		},
+		{
+			Path:               sign("secret", "width:1"),
+			Resizer:            ResizerMock{Res: rendered},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "thumbnail size 1x1 is out of bounds [16, 2048]",
+		},
+		{
+			Path:               "/resize/only/two",
+			Resizer:            ResizerMock{Res: rendered},
+			ExpectedStatusCode: http.StatusNotFound,
+			ExpectedBody:       "Bad resize path",
+		},
+	}
+
+	store := storage.NewMemory()
+	cached := resizeCacheID("width:128", source, nil) + ".png"
+	if err := store.Put(context.Background(), cached, []byte("cached bytes")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tCase := range testCases {
+		config.Set(config.ResizeURLCache, tCase.Cache)
+		method := tCase.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		req := httptest.NewRequest(method, "https://example.org"+tCase.Path, nil)
+		req.Header.Set("Accept", tCase.Accept)
+		router := NewRouter(&tCase.Resizer, store, flatLayout)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		if w.Code != tCase.ExpectedStatusCode {
+			t.Errorf("Case %v. Bad status code. Expected '%v', got '%v'", i, tCase.ExpectedStatusCode, w.Code)
+		}
+
+		if w.Body.String() != tCase.ExpectedBody {
+			t.Errorf("Case %v. Bad body value. Expected '%v', got '%v'", i, tCase.ExpectedBody, w.Body.String())
+		}
+
+		//"-" - тип содержимого не указывается
+		if ct := w.Header().Get("Content-Type"); tCase.ExpectedContentType == "-" && ct != "" ||
+			tCase.ExpectedContentType != "" && tCase.ExpectedContentType != "-" && ct != tCase.ExpectedContentType {
+			t.Errorf("Case %v. Bad content type. Expected '%v', got '%v'", i, tCase.ExpectedContentType, ct)
+		}
+
+		if tCase.Resizer.Entered != tCase.ExpectedEnter {
+			t.Errorf("Case %v. Bad value entered to resizer method. Expected '%v', got '%v'", i, tCase.ExpectedEnter, tCase.Resizer.Entered)
+		}
+
+		if !reflect.DeepEqual(tCase.Resizer.EnteredOpts, tCase.ExpectedOpts) {
+			t.Errorf("Case %v. Bad options entered to resizer method. Expected '%+v', got '%+v'", i, tCase.ExpectedOpts, tCase.Resizer.EnteredOpts)
+		}
+
+		if tCase.Resizer.EnteredID != tCase.ExpectedID {
+			t.Errorf("Case %v. Bad id entered to resizer method. Expected '%v', got '%v'", i, tCase.ExpectedID, tCase.Resizer.EnteredID)
+		}
+	}
+}
+
+func TestThumbnailGet(t *testing.T) {
+	store := storage.NewMemory()
+	ctx := context.Background()
+	if err := store.Put(ctx, "some-id.png", []byte("some bytes")); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := store.Stat(ctx, "some-id.png")
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime.UnixNano(), info.Size)
+
+	for _, ext := range []string{".jpeg", ".webp"} {
+		if err := store.Put(ctx, "multi-id"+ext, []byte(ext)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		Method              string
+		Path                string
+		Header              http.Header
+		ExpectedStatusCode  int
+		ExpectedContentType string
+		ExpectedBody        string
+	}{
+		{
+			Method:              http.MethodGet,
+			Path:                "/thumbnails/some-id",
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "image/png",
+			ExpectedBody:        "some bytes",
+		},
+		{
+			Method:              http.MethodGet,
+			Path:                "/thumbnails/some-id.png",
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "image/png",
+			ExpectedBody:        "some bytes",
+		},
+		{
+			Method:             http.MethodGet,
+			Path:               "/thumbnails/some-id",
+			Header:             http.Header{"If-None-Match": []string{etag}},
+			ExpectedStatusCode: http.StatusNotModified,
+		},
+		{
+			Method:              http.MethodGet,
+			Path:                "/thumbnails/multi-id",
+			Header:              http.Header{"Accept": []string{"image/webp,*/*"}},
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "image/webp",
+			ExpectedBody:        ".webp",
+		},
+		{
+			Method:              http.MethodGet,
+			Path:                "/thumbnails/multi-id",
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "image/jpeg",
+			ExpectedBody:        ".jpeg",
+		},
+		{
+			Method:             http.MethodGet,
+			Path:               "/thumbnails/another-id",
+			ExpectedStatusCode: http.StatusNotFound,
+			ExpectedBody:       "Thumbnail not found",
+		},
+		{
+			Method:             http.MethodGet,
+			Path:               "/thumbnails/some*",
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Bad thumbnail id",
+		},
+		{
+			Method:             http.MethodPost,
+			Path:               "/thumbnails/some-id",
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "The path with this method is missing.",
+		},
+	}
+
+	for _, tCase := range testCases {
+		req := httptest.NewRequest(tCase.Method, "https://example.org"+tCase.Path, nil)
+		for k, v := range tCase.Header {
+			req.Header[k] = v
+		}
+		router := NewRouter(&ResizerMock{}, store, flatLayout)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		if w.Code != tCase.ExpectedStatusCode {
+			t.Errorf("Bad status code for '%v'. Expected '%v', got '%v'", tCase.Path, tCase.ExpectedStatusCode, w.Code)
+		}
+
+		if w.Body.String() != tCase.ExpectedBody {
+			t.Errorf("Bad body value for '%v'. Expected '%v', got '%v'", tCase.Path, tCase.ExpectedBody, w.Body.String())
+		}
+
+		if ct := w.Header().Get("Content-Type"); tCase.ExpectedContentType != "" && ct != tCase.ExpectedContentType {
+			t.Errorf("Bad content type for '%v'. Expected '%v', got '%v'", tCase.Path, tCase.ExpectedContentType, ct)
+		}
+	}
+}
+
+func TestAsyncJobs(t *testing.T) {
+	var jobStatus = &resizer.JobStatus{
+		ID:      "job-id",
+		Status:  resizer.JobDone,
+		Results: []*resizer.Result{testResult},
+	}
+	jobJSON, _ := json.Marshal(jobStatus)
+
+	testCases := []struct {
+		Request            func() *http.Request
+		ExpectedStatusCode int
+		ExpectedEnter      string
+		ExpectedCallback   string
+		ExpectedLocation   string
+		ExpectedBody       string
+	}{
+		{
+			Request:            getRequest(url.Values{"url": {"someUrl"}, "async": {"true"}}),
+			ExpectedStatusCode: http.StatusAccepted,
+			ExpectedEnter:      "someUrl",
+			ExpectedLocation:   "/jobs/job-id",
+			ExpectedBody:       `{"id":"job-id","status":"queued"}` + "\n",
+		},
+		{
+			Request: func() *http.Request {
+				body := `{"image":"` + base64.StdEncoding.EncodeToString([]byte("img")) + `","async":true}`
+				req := httptest.NewRequest(http.MethodPost, "https://example.org", bytes.NewReader([]byte(body)))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			ExpectedStatusCode: http.StatusAccepted,
+			ExpectedEnter:      "img",
+			ExpectedLocation:   "/jobs/job-id",
+			ExpectedBody:       `{"id":"job-id","status":"queued"}` + "\n",
+		},
+		{
+			Request:            getRequest(url.Values{"url": {"someUrl"}, "callback_url": {"https://cms.example.org/hook"}}),
+			ExpectedStatusCode: http.StatusAccepted,
+			ExpectedEnter:      "someUrl",
+			ExpectedCallback:   "https://cms.example.org/hook",
+			ExpectedLocation:   "/jobs/job-id",
+			ExpectedBody:       `{"id":"job-id","status":"queued"}` + "\n",
+		},
+		{
+			Request: func() *http.Request {
+				body := `{"image":"` + base64.StdEncoding.EncodeToString([]byte("img")) + `","callback_url":"ftp://cms"}`
+				req := httptest.NewRequest(http.MethodPost, "https://example.org", bytes.NewReader([]byte(body)))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Bad value of parameter 'callback_url': ftp://cms",
+		},
+		{
+			Request:            getRequest(url.Values{"url": {"someUrl"}, "async": {"maybe"}}),
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Bad value of parameter 'async': maybe",
+		},
+		{
+			Request: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "https://example.org/jobs/job-id", nil)
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedBody:       string(jobJSON) + "\n",
+		},
+		{
+			Request: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "https://example.org/jobs/another-id", nil)
+			},
+			ExpectedStatusCode: http.StatusNotFound,
+			ExpectedBody:       "Job not found",
+		},
+		{
+			Request: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "https://example.org/jobs/job*", nil)
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Bad job id",
+		},
+	}
+
+	for i, tCase := range testCases {
+		resizerMock := &ResizerMock{JobID: "job-id", JobStatus: jobStatus}
+		router := NewRouter(resizerMock, storage.NewMemory(), flatLayout)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, tCase.Request())
+
+		if w.Code != tCase.ExpectedStatusCode {
+			t.Errorf("Bad status code in case %v. Expected '%v', got '%v'", i, tCase.ExpectedStatusCode, w.Code)
+		}
+
+		if w.Body.String() != tCase.ExpectedBody {
+			t.Errorf("Bad body value in case %v. Expected '%v', got '%v'", i, tCase.ExpectedBody, w.Body.String())
+		}
+
+		if resizerMock.Entered != tCase.ExpectedEnter {
+			t.Errorf("Bad entered value in case %v. Expected '%v', got '%v'", i, tCase.ExpectedEnter, resizerMock.Entered)
+		}
+
+		if resizerMock.Callback != tCase.ExpectedCallback {
+			t.Errorf("Bad callback in case %v. Expected '%v', got '%v'", i, tCase.ExpectedCallback, resizerMock.Callback)
+		}
+
+		if loc := w.Header().Get("Location"); loc != tCase.ExpectedLocation {
+			t.Errorf("Bad location in case %v. Expected '%v', got '%v'", i, tCase.ExpectedLocation, loc)
+		}
+	}
+}
+
+//batchResizerMock не сохраняет аргументы, чтобы его можно было вызывать параллельно
+type batchResizerMock struct {
+	ResizerMock
+}
+
+func (r *batchResizerMock) FromUrl(ctx context.Context, url string, variants []resizer.Options) ([]*resizer.Result, error) {
+	if url == "bad-url" {
+		return nil, fmt.Errorf("can't get image")
+	}
+	return r.results(variants), nil
+}
+
+func (r *batchResizerMock) ResizeImg(ctx context.Context, img []byte, variants []resizer.Options) ([]*resizer.Result, error) {
+	return r.results(variants), nil
+}
+
+func TestBatch(t *testing.T) {
+	config.Set(config.MaxBatchItems, 4)
+	defer config.Set(config.MaxBatchItems, 1000)
+	config.Set(config.MaxBatchBodyByte, 256)
+	defer config.Set(config.MaxBatchBodyByte, 64*1024*1024)
+
+	var items = `["some-url", {"url": "bad-url"}, {"image": "aW1n", "widths": [64, 128]}, {}]`
+	var expected = []batchResult{
+		{Index: 0, URL: "some-url", Results: []*resizer.Result{testResult}},
+		{Index: 1, URL: "bad-url", Error: "can't get image"},
+		{Index: 2, Results: []*resizer.Result{testResult, testResult}},
+		{Index: 3, Error: "Item must contain either 'url' or 'image'"},
+	}
+
+	testCases := []struct {
+		ContentType         string
+		Accept              string
+		Body                string
+		ExpectedStatusCode  int
+		ExpectedContentType string
+		Expected            []batchResult
+		ExpectedBody        string
+	}{
+		{
+			ContentType:         "application/json",
+			Body:                items,
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: "application/json",
+			Expected:            expected,
+		},
+		{
+			ContentType:         "application/json",
+			Accept:              ndjsonMimeType,
+			Body:                items,
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: ndjsonMimeType,
+			Expected:            expected,
+		},
+		{
+			ContentType:         ndjsonMimeType,
+			Body:                "\"some-url\"\n{\"url\": \"bad-url\"}\n\n{\"image\": \"aW1n\", \"widths\": [64, 128]}\n{}\n{bad\n",
+			ExpectedStatusCode:  http.StatusOK,
+			ExpectedContentType: ndjsonMimeType,
+			Expected: append(expected[:len(expected):len(expected)], batchResult{
+				Index: 4,
+				Error: "invalid character 'b' looking for beginning of object key string",
+			}),
+		},
+		{
+			ContentType:        "application/json",
+			Body:               `[]`,
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Batch cannot be empty",
+		},
+		{
+			ContentType:        "application/json",
+			Body:               `["1", "2", "3", "4", "5"]`,
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Batch is too large. Max items: 4",
+		},
+		{
+			//лишние элементы не дочитываются
+			ContentType:        "application/json",
+			Body:               `["1", "2", "3", "4", "5", {bad`,
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Batch is too large. Max items: 4",
+		},
+		{
+			ContentType:        "application/json",
+			Body:               `["` + strings.Repeat("a", 300) + `"]`,
+			ExpectedStatusCode: http.StatusRequestEntityTooLarge,
+			ExpectedBody:       "Batch body is too large. Max bytes: 256",
+		},
+		{
+			ContentType:        "application/json",
+			Body:               `{"url": "some-url"}`,
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Batch must be a json array",
+		},
+		{
+			ContentType:        "text/plain",
+			Body:               `some-url`,
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Underfined content-type for batch:text/plain",
+		},
+	}
+
+	for i, tCase := range testCases {
+		req := httptest.NewRequest(http.MethodPost, "https://example.org/batch", bytes.NewReader([]byte(tCase.Body)))
+		req.Header.Set("Content-Type", tCase.ContentType)
+		req.Header.Set("Accept", tCase.Accept)
+		router := NewRouter(&batchResizerMock{ResizerMock{Res: testResult}}, storage.NewMemory(), flatLayout)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		if w.Code != tCase.ExpectedStatusCode {
+			t.Errorf("Bad status code in case %v. Expected '%v', got '%v'", i, tCase.ExpectedStatusCode, w.Code)
+		}
+
+		if tCase.Expected == nil {
+			if w.Body.String() != tCase.ExpectedBody {
+				t.Errorf("Bad body value in case %v. Expected '%v', got '%v'", i, tCase.ExpectedBody, w.Body.String())
+			}
+			continue
+		}
+
+		if ct := w.Header().Get("Content-Type"); ct != tCase.ExpectedContentType {
+			t.Errorf("Bad content type in case %v. Expected '%v', got '%v'", i, tCase.ExpectedContentType, ct)
+		}
+
+		var got []batchResult
+		if tCase.ExpectedContentType == ndjsonMimeType {
+			decoder := json.NewDecoder(w.Body)
+			for decoder.More() {
+				var res batchResult
+				if err := decoder.Decode(&res); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, res)
+			}
+			sort.Slice(got, func(i, j int) bool {
+				return got[i].Index < got[j].Index
+			})
+		} else if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, tCase.Expected) {
+			t.Errorf("Bad batch results in case %v. Expected '%+v', got '%+v'", i, tCase.Expected, got)
+		}
+	}
+}
+
+func TestBatchStream(t *testing.T) {
+	router := NewRouter(&batchResizerMock{ResizerMock{Res: testResult}}, storage.NewMemory(), flatLayout)
+	server := httptest.NewUnstartedServer(&router)
+	//поток ndjson дольше серверных таймаутов
+	server.Config.ReadTimeout = 100 * time.Millisecond
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	body, input := io.Pipe()
+	defer input.Close()
+	go input.Write([]byte("\"first-url\"\n"))
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+batchPath, body)
+	req.Header.Set("Content-Type", ndjsonMimeType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+
+	//результат первого элемента приходит до конца запроса
+	var res batchResult
+	if err := decoder.Decode(&res); err != nil || res.URL != "first-url" {
+		t.Fatalf("Bad first result. Expected '%v', got '%+v', error '%v'", "first-url", res, err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	input.Write([]byte("\"second-url\"\n"))
+	input.Close()
+	if err := decoder.Decode(&res); err != nil || res.URL != "second-url" {
+		t.Errorf("Bad second result. Expected '%v', got '%+v', error '%v'", "second-url", res, err)
+	}
+}
+
+func TestThumbnailLayouts(t *testing.T) {
+	store := storage.NewMemory()
+	ctx := context.Background()
+	for _, name := range []string{"ab/cd/abcd1234.webp", "ab/cd/abcd1234.jpeg", "ab/cd/abcd1234_64x64_crop.png", "2026/10/17/xyz.png"} {
+		if err := store.Put(ctx, name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sharded, _ := storage.NewLayout(storage.LayoutSharded)
+	dated, _ := storage.NewLayout(storage.LayoutDated)
+
+	testCases := []struct {
+		Layout             *storage.Layout
+		Path               string
+		Accept             string
+		ExpectedStatusCode int
+		ExpectedBody       string
+	}{
+		{sharded, "/thumbnails/abcd1234", "image/webp", http.StatusOK, "ab/cd/abcd1234.webp"},
+		{sharded, "/thumbnails/abcd1234", "", http.StatusOK, "ab/cd/abcd1234.jpeg"},
+		{sharded, "/thumbnails/abcd1234_64x64_crop.png", "", http.StatusOK, "ab/cd/abcd1234_64x64_crop.png"},
+		{sharded, "/thumbnails/ab/cd/abcd1234.webp", "", http.StatusOK, "ab/cd/abcd1234.webp"},
+		{dated, "/thumbnails/xyz", "", http.StatusNotFound, "Thumbnail not found"},
+		{dated, "/thumbnails/2026/10/17/xyz", "", http.StatusOK, "2026/10/17/xyz.png"},
+		{dated, "/thumbnails/2026/../xyz.png", "", http.StatusBadRequest, "Bad thumbnail id"},
+	}
+
+	for i, tCase := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "https://example.org"+tCase.Path, nil)
+		req.Header.Set("Accept", tCase.Accept)
+		router := NewRouter(&ResizerMock{}, store, tCase.Layout)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		if w.Code != tCase.ExpectedStatusCode {
+			t.Errorf("Bad status code in case %v. Expected '%v', got '%v'", i, tCase.ExpectedStatusCode, w.Code)
+		}
+
+		if w.Body.String() != tCase.ExpectedBody {
+			t.Errorf("Bad body value in case %v. Expected '%v', got '%v'", i, tCase.ExpectedBody, w.Body.String())
+		}
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	defer config.Set(config.QueueFullStatus, http.StatusServiceUnavailable)
+
+	testCases := []struct {
+		Status             int
+		Query              string
+		Err                error
+		ExpectedStatusCode int
+		ExpectedRetryAfter string
+	}{
+		{http.StatusServiceUnavailable, "url=some-url", &resizer.QueueFullError{Queue: "resize", RetryAfter: 2500 * time.Millisecond}, http.StatusServiceUnavailable, "3"},
+		{http.StatusTooManyRequests, "url=some-url", &resizer.QueueFullError{Queue: "request", RetryAfter: time.Second}, http.StatusTooManyRequests, "1"},
+		{http.StatusServiceUnavailable, "url=some-url", fmt.Errorf("resize error"), http.StatusInternalServerError, ""},
+		{http.StatusServiceUnavailable, "url=some-url&async=true", &resizer.QueueFullError{Queue: "request", RetryAfter: 2 * time.Second}, http.StatusServiceUnavailable, "2"},
+		{http.StatusTooManyRequests, "url=some-url&callback_url=https://cms.example.org/hook", &resizer.QueueFullError{Queue: "request", RetryAfter: time.Second}, http.StatusTooManyRequests, "1"},
+	}
+
+	for i, tCase := range testCases {
+		config.Set(config.QueueFullStatus, tCase.Status)
+		router := NewRouter(&ResizerMock{Err: tCase.Err}, storage.NewMemory(), flatLayout)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://example.org?"+tCase.Query, nil))
+
+		if w.Code != tCase.ExpectedStatusCode {
+			t.Errorf("Bad status code in case %v. Expected '%v', got '%v'", i, tCase.ExpectedStatusCode, w.Code)
+		}
+		if ra := w.Header().Get("Retry-After"); ra != tCase.ExpectedRetryAfter {
+			t.Errorf("Bad Retry-After in case %v. Expected '%v', got '%v'", i, tCase.ExpectedRetryAfter, ra)
+		}
+		if w.Body.String() != tCase.Err.Error() {
+			t.Errorf("Bad body in case %v. Expected '%v', got '%v'", i, tCase.Err.Error(), w.Body.String())
+		}
+	}
+}
+
+func TestThumbnailDelete(t *testing.T) {
+	sharded, _ := storage.NewLayout(storage.LayoutSharded)
+	dated, _ := storage.NewLayout(storage.LayoutDated)
+
+	testCases := []struct {
+		Layout             *storage.Layout
+		Path               string
+		ExpectedStatusCode int
+		ExpectedDeleted    []string
+		ExpectedLeft       []string
+	}{
+		{flatLayout, "/thumbnails/abcd1234", http.StatusOK,
+			[]string{"abcd1234.webp", "abcd1234_avatar.png"},
+			[]string{"ab/cd/abcd1234.webp", "ab/cd/abcd1234_avatar.jpeg", "abcd12345.png", "2026/10/17/abcd1234_card.png"}},
+		{flatLayout, "/thumbnails/abcd1234.webp", http.StatusOK,
+			[]string{"abcd1234.webp"},
+			[]string{"ab/cd/abcd1234.webp", "ab/cd/abcd1234_avatar.jpeg", "abcd1234_avatar.png", "abcd12345.png", "2026/10/17/abcd1234_card.png"}},
+		{sharded, "/thumbnails/abcd1234", http.StatusOK,
+			[]string{"ab/cd/abcd1234.webp", "ab/cd/abcd1234_avatar.jpeg"},
+			[]string{"abcd1234.webp", "abcd1234_avatar.png", "abcd12345.png", "2026/10/17/abcd1234_card.png"}},
+		{dated, "/thumbnails/abcd1234", http.StatusBadRequest, nil, nil},
+		{dated, "/thumbnails/abcd1234.webp", http.StatusBadRequest, nil, nil},
+		{dated, "/thumbnails/2026/10/17/abcd1234", http.StatusOK,
+			[]string{"2026/10/17/abcd1234_card.png"},
+			[]string{"ab/cd/abcd1234.webp", "ab/cd/abcd1234_avatar.jpeg", "abcd1234.webp", "abcd1234_avatar.png", "abcd12345.png"}},
+		{flatLayout, "/thumbnails/missing", http.StatusNotFound, nil, nil},
+		{flatLayout, "/thumbnails/missing.png", http.StatusNotFound, nil, nil},
+		{flatLayout, "/thumbnails/../abcd1234", http.StatusBadRequest, nil, nil},
+	}
+
+	for i, tCase := range testCases {
+		store := storage.NewMemory()
+		ctx := context.Background()
+		for _, name := range []string{"abcd1234.webp", "abcd1234_avatar.png", "abcd12345.png",
+			"ab/cd/abcd1234.webp", "ab/cd/abcd1234_avatar.jpeg", "2026/10/17/abcd1234_card.png"} {
+			if err := store.Put(ctx, name, []byte(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		req := httptest.NewRequest(http.MethodDelete, "https://example.org"+tCase.Path, nil)
+		router := NewRouter(&ResizerMock{}, store, tCase.Layout)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		if w.Code != tCase.ExpectedStatusCode {
+			t.Errorf("Bad status code in case %v. Expected '%v', got '%v'", i, tCase.ExpectedStatusCode, w.Code)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		var res struct {
+			Deleted []string `json:"deleted"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("Bad body in case %v: %v", i, err)
+		}
+		sort.Strings(res.Deleted)
+		sort.Strings(tCase.ExpectedDeleted)
+		if !reflect.DeepEqual(res.Deleted, tCase.ExpectedDeleted) {
+			t.Errorf("Bad deleted files in case %v. Expected '%v', got '%v'", i, tCase.ExpectedDeleted, res.Deleted)
+		}
+
+		files, _ := store.List(ctx, "", "", 0)
+		var left []string
+		for _, file := range files {
+			left = append(left, file.Name)
+		}
+		sort.Strings(tCase.ExpectedLeft)
+		if !reflect.DeepEqual(left, tCase.ExpectedLeft) {
+			t.Errorf("Bad remaining files in case %v. Expected '%v', got '%v'", i, tCase.ExpectedLeft, left)
+		}
+	}
+}
+
+func TestThumbnailList(t *testing.T) {
+	store := storage.NewMemory()
+	ctx := context.Background()
+	for _, name := range []string{"a.png", "b.jpeg", "c.webp", "x/d.png", "x/e.png"} {
+		if err := store.Put(ctx, name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := NewRouter(&ResizerMock{}, store, flatLayout)
+
+	list := func(query string) (int, []string, string) {
+		req := httptest.NewRequest(http.MethodGet, "https://example.org/thumbnails?"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			return w.Code, nil, ""
+		}
+
+		var page struct {
+			Items []struct {
+				ID      string    `json:"id"`
+				Path    string    `json:"path"`
+				Size    int64     `json:"size"`
+				Created time.Time `json:"created"`
+			} `json:"items"`
+			NextCursor string `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("Bad body for '%v': %v", query, err)
+		}
+		var paths []string
+		for _, item := range page.Items {
+			if item.Size != int64(len(item.Path)) || item.Created.IsZero() || item.ID != strings.TrimSuffix(path.Base(item.Path), path.Ext(item.Path)) {
+				t.Errorf("Bad item for '%v': %+v", query, item)
+			}
+			paths = append(paths, item.Path)
+		}
+		return w.Code, paths, page.NextCursor
+	}
+
+	var all []string
+	var cursor string
+	for pages := 0; ; pages++ {
+		code, paths, next := list("limit=2&cursor=" + cursor)
+		if code != http.StatusOK || pages > 3 {
+			t.Fatalf("Bad paging. Code '%v', page %v", code, pages)
+		}
+		all = append(all, paths...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	expected := []string{"a.png", "b.jpeg", "c.webp", "x/d.png", "x/e.png"}
+	if !reflect.DeepEqual(all, expected) {
+		t.Errorf("Bad paged list. Expected '%v', got '%v'", expected, all)
+	}
+
+	if _, paths, next := list("prefix=x/"); !reflect.DeepEqual(paths, []string{"x/d.png", "x/e.png"}) || next != "" {
+		t.Errorf("Bad list with prefix. Expected '%v', got '%v', cursor '%v'", []string{"x/d.png", "x/e.png"}, paths, next)
+	}
+
+	for _, query := range []string{"prefix=../", "cursor=!!", "limit=0", "limit=100000", "limit=a"} {
+		if code, _, _ := list(query); code != http.StatusBadRequest {
+			t.Errorf("Bad status code for '%v'. Expected '%v', got '%v'", query, http.StatusBadRequest, code)
+		}
+	}
+}
+
+func getRequest(vals url.Values) func() *http.Request {
+	return func() *http.Request {
+		return httptest.NewRequest(http.MethodGet, "https://example.org?"+vals.Encode(), nil)
+	}
+}
+
+func createVals(name string, vals ...string) url.Values {
+	var urlVals = url.Values{}
+	for _, v := range vals {
+		urlVals.Add(name, v)
+	}
+	return urlVals
+}
+
+func multipartBody(formName string, val string) (*bytes.Buffer, *multipart.Writer) {
+	bodyBuf := &bytes.Buffer{}
+	bodyWriter := multipart.NewWriter(bodyBuf)
+
+	fileWriter, err := bodyWriter.CreateFormFile(formName, "filename.jpeg")
+	if err != nil {
+		fmt.Print(err.Error())
+	}
+
+	br := bytes.NewReader([]byte(val))
+	io.Copy(fileWriter, br)
+
+	return bodyBuf, bodyWriter
+}
+
+func jsonBody(formName string, val string) []byte {
+	jsonVal, err := json.Marshal(map[string]string{
+		formName: base64.StdEncoding.
+			EncodeToString([]byte(val)),
+	})
+	if err != nil {
+		fmt.Print(err.Error())
+	}
+	return jsonVal
+}
+
+func TestPriority(t *testing.T) {
+	prevKeys := config.GetString(config.PriorityAPIKeys)
+	config.Set(config.PriorityAPIKeys, "import-key=bulk; cms-key=interactive")
+	defer config.Set(config.PriorityAPIKeys, prevKeys)
+
+	withKey := func(req func() *http.Request, key string) func() *http.Request {
+		return func() *http.Request {
+			r := req()
+			r.Header.Set(apiKeyHeader, key)
+			return r
+		}
+	}
+	batchRequest := func(query, body string) func() *http.Request {
+		return func() *http.Request {
+			req := httptest.NewRequest(http.MethodPost, "https://example.org/batch"+query, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			return req
+		}
+	}
+
+	testCases := []struct {
+		Request            func() *http.Request
+		ExpectedStatusCode int
+		ExpectedPriority   resizer.Priority
+		ExpectedBody       string
+	}{
+		{
+			Request:            getRequest(url.Values{"url": {"someUrl"}}),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedPriority:   resizer.PriorityInteractive,
+		},
+		{
+			Request:            getRequest(url.Values{"url": {"someUrl"}, "priority": {"bulk"}}),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedPriority:   resizer.PriorityBulk,
+		},
+		{
+			Request:            getRequest(url.Values{"url": {"someUrl"}, "priority": {"bulk"}, "async": {"true"}}),
+			ExpectedStatusCode: http.StatusAccepted,
+			ExpectedPriority:   resizer.PriorityBulk,
+		},
+		{
+			Request:            getRequest(url.Values{"url": {"someUrl"}, "priority": {"urgent"}}),
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Bad value of parameter 'priority': urgent",
+		},
+		{
+			Request:            withKey(getRequest(url.Values{"url": {"someUrl"}}), "import-key"),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedPriority:   resizer.PriorityBulk,
+		},
+		{
+			Request:            withKey(getRequest(url.Values{"url": {"someUrl"}, "priority": {"bulk"}}), "cms-key"),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedPriority:   resizer.PriorityInteractive,
+		},
+		{
+			Request:            withKey(getRequest(url.Values{"url": {"someUrl"}, "priority": {"bulk"}}), "unknown-key"),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedPriority:   resizer.PriorityBulk,
+		},
+		{
+			Request: func() *http.Request {
+				body := `{"image":"` + base64.StdEncoding.EncodeToString([]byte("img")) + `","priority":"bulk"}`
+				req := httptest.NewRequest(http.MethodPost, "https://example.org", bytes.NewReader([]byte(body)))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedPriority:   resizer.PriorityBulk,
+		},
+		{
+			Request: func() *http.Request {
+				body := `{"image":"` + base64.StdEncoding.EncodeToString([]byte("img")) + `","priority":"urgent"}`
+				req := httptest.NewRequest(http.MethodPost, "https://example.org", bytes.NewReader([]byte(body)))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Bad value of parameter 'priority': urgent",
+		},
+		{
+			Request:            batchRequest("", `["someUrl"]`),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedPriority:   resizer.PriorityBulk,
+		},
+		{
+			Request:            batchRequest("?priority=interactive", `["someUrl"]`),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedPriority:   resizer.PriorityInteractive,
+		},
+		{
+			Request:            batchRequest("?priority=interactive", `[{"url":"someUrl","priority":"bulk"}]`),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedPriority:   resizer.PriorityBulk,
+		},
+		{
+			Request:            batchRequest("?priority=urgent", `["someUrl"]`),
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedBody:       "Bad value of parameter 'priority': urgent\n",
+		},
+	}
+
+	for i, tc := range testCases {
+		mock := &ResizerMock{Res: testResult, JobID: "job-id"}
+		router := NewRouter(mock, nil, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, tc.Request())
+
+		if w.Code != tc.ExpectedStatusCode {
+			t.Errorf("Case %d. Bad status code. Expected '%v', got '%v'", i, tc.ExpectedStatusCode, w.Code)
+		}
+		if mock.Priority != tc.ExpectedPriority {
+			t.Errorf("Case %d. Bad priority. Expected '%v', got '%v'", i, tc.ExpectedPriority, mock.Priority)
+		}
+		if tc.ExpectedBody != "" && w.Body.String() != tc.ExpectedBody {
+			t.Errorf("Case %d. Bad body. Expected '%v', got '%v'", i, tc.ExpectedBody, w.Body.String())
+		}
+	}
+}
+
+func TestCheckPriority(t *testing.T) {
+	prevKeys := config.GetString(config.PriorityAPIKeys)
+	prevBatch := config.GetString(config.BatchPriority)
+	defer func() {
+		config.Set(config.PriorityAPIKeys, prevKeys)
+		config.Set(config.BatchPriority, prevBatch)
+	}()
+
+	testCases := []struct {
+		Keys     string
+		Batch    string
+		ExpectOK bool
+	}{
+		{"", "bulk", true},
+		{"a=bulk;b=interactive;", "interactive", true},
+		{"a=urgent", "bulk", false},
+		{"a", "bulk", false},
+		{"=bulk", "bulk", false},
+		{"", "urgent", false},
+	}
+
+	for i, tc := range testCases {
+		config.Set(config.PriorityAPIKeys, tc.Keys)
+		config.Set(config.BatchPriority, tc.Batch)
+		if err := CheckPriority(); (err == nil) != tc.ExpectOK {
+			t.Errorf("Case %d. Bad check result. Expected ok '%v', got error '%v'", i, tc.ExpectOK, err)
+		}
+	}
+}
+
+func TestCheckBatch(t *testing.T) {
+	defer func() {
+		config.Set(config.BatchConcurrency, 50)
+		config.Set(config.MaxBatchItems, 1000)
+		config.Set(config.BatchTimeoutSec, 3600)
+	}()
+
+	testCases := []struct {
+		Concurrency int
+		MaxItems    int
+		TimeoutSec  int
+		ExpectOK    bool
+	}{
+		{50, 1000, 3600, true},
+		{1, 1, 0, true},
+		{0, 1000, 3600, false},
+		{50, 0, 3600, false},
+		{50, 1000, -1, false},
+	}
+
+	for i, tc := range testCases {
+		config.Set(config.BatchConcurrency, tc.Concurrency)
+		config.Set(config.MaxBatchItems, tc.MaxItems)
+		config.Set(config.BatchTimeoutSec, tc.TimeoutSec)
+		if err := CheckBatch(); (err == nil) != tc.ExpectOK {
+			t.Errorf("Case %d. Bad check result. Expected ok '%v', got error '%v'", i, tc.ExpectOK, err)
+		}
+	}
+}
+
+func TestCheckResizeURL(t *testing.T) {
+	defer config.Set(config.ResizeURLCache, false)
+
+	testCases := []struct {
+		Layout   string
+		Cache    bool
+		ExpectOK bool
+	}{
+		{"flat", true, true},
+		{"sharded", true, true},
+		{"{tenant}/{id}.{ext}", true, false},
+		{"dated", true, false},
+		{"dated", false, true},
+	}
+
+	for i, tc := range testCases {
+		layout, err := storage.NewLayout(tc.Layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Set(config.ResizeURLCache, tc.Cache)
+		if err := CheckResizeURL(layout); (err == nil) != tc.ExpectOK {
+			t.Errorf("Case %d. Bad check result. Expected ok '%v', got error '%v'", i, tc.ExpectOK, err)
+		}
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	pools := []resizer.PoolStatus{{
+		Stage:    "resize",
+		Workers:  3,
+		Min:      2,
+		Max:      8,
+		QueueLen: 5,
+		QueueCap: 10,
+		Decisions: []resizer.ScaleDecision{
+			{Time: time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC), From: 2, To: 3, Reason: "queue is 50% full"},
+		},
+	}}
+	expected, _ := json.Marshal(pools)
+
+	testCases := []struct {
+		Method             string
+		ExpectedStatusCode int
+		ExpectedBody       string
+	}{
+		{http.MethodGet, http.StatusOK, string(expected) + "\n"},
+		{http.MethodPost, http.StatusBadRequest, "The path with this method is missing."},
+	}
+
+	for _, tc := range testCases {
+		router := NewRouter(&ResizerMock{Pools: pools}, nil, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(tc.Method, "https://example.org/workers", nil))
+
+		if w.Code != tc.ExpectedStatusCode {
+			t.Errorf("Bad status code for %s. Expected '%v', got '%v'", tc.Method, tc.ExpectedStatusCode, w.Code)
+		}
+		if w.Body.String() != tc.ExpectedBody {
+			t.Errorf("Bad body for %s. Expected '%v', got '%v'", tc.Method, tc.ExpectedBody, w.Body.String())
+		}
 	}
-	return jsonVal
 }
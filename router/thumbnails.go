@@ -0,0 +1,287 @@
+package router
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"staply_img_resizer/config"
+	"staply_img_resizer/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const thumbnailsPath = "/thumbnails/"
+
+//thumbnailIDRe допустимый ID миниатюры или путь файла в хранилище, с расширением или без
+var thumbnailIDRe = regexp.MustCompile(`^([A-Za-z0-9_-]+/)*[A-Za-z0-9_-]+(\.[A-Za-z0-9]+)?$`)
+
+//thumbnails выдача, удаление и список сохранённых миниатюр
+func (router *Router) thumbnails(w http.ResponseWriter, r *http.Request) {
+	var list = strings.TrimPrefix(r.URL.Path+"/", thumbnailsPath) == ""
+	switch {
+	case list && r.Method == http.MethodGet:
+		router.listThumbnails(w, r)
+	case !list && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		router.thumbnailByID(w, r)
+	case !list && r.Method == http.MethodDelete:
+		router.deleteThumbnail(w, r)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("The path with this method is missing."))
+	}
+}
+
+func (router *Router) thumbnailByID(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, thumbnailsPath)
+	if !thumbnailIDRe.MatchString(id) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Bad thumbnail id"))
+		return
+	}
+
+	//без расширения файл выбирается по Accept
+	if path.Ext(id) == "" {
+		w.Header().Set("Vary", "Accept")
+	}
+
+	name, err := findThumbnail(r.Context(), router.Storage, router.Layout, id, r.Header.Get("Accept"))
+	if err != nil {
+		if err == storage.ErrNotExist {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Thumbnail not found"))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	router.serveThumbnailFile(w, r, name)
+}
+
+//serveThumbnailFile отдаёт файл миниатюры из хранилища с поддержкой условных запросов
+func (router *Router) serveThumbnailFile(w http.ResponseWriter, r *http.Request, name string) {
+	file, info, err := router.Storage.Get(r.Context(), name)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer file.Close()
+
+	if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime.UnixNano(), info.Size))
+
+	//ServeContent сам выставляет Content-Length, Last-Modified и отвечает 304
+	http.ServeContent(w, r, path.Base(name), info.ModTime, file)
+}
+
+//findThumbnail ищет файл миниатюры в хранилище по ID или пути файла.
+//ID переводится в путь через раскладку хранилища, если она это позволяет.
+//Если расширение не указано, подходит файл с любым расширением,
+//а из нескольких форматов выбирается подходящий по Accept
+func findThumbnail(ctx context.Context, store storage.Storage, layout *storage.Layout, id string, accept string) (string, error) {
+	var name = id
+	if !strings.Contains(id, "/") {
+		if !layout.Resolvable() {
+			return "", storage.ErrNotExist
+		}
+		ext := path.Ext(id)
+		name = layout.Key(storage.Fields{
+			ID:  strings.TrimSuffix(id, ext),
+			Ext: strings.TrimPrefix(ext, "."),
+		})
+		name = strings.TrimSuffix(name, ".")
+	}
+
+	if path.Ext(name) != "" {
+		_, err := store.Stat(ctx, name)
+		return name, err
+	}
+
+	files, err := store.List(ctx, name+".", "", 0)
+	if err != nil {
+		return "", err
+	}
+
+	var names []string
+	for _, file := range files {
+		if ext := strings.TrimPrefix(file.Name, name+"."); !strings.ContainsAny(ext, "./") {
+			names = append(names, file.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "", storage.ErrNotExist
+	}
+	return pickByAccept(names, accept), nil
+}
+
+//deleteThumbnail удаляет миниатюру: с расширением - один файл,
+//без расширения - все варианты с этим ID в качестве общего
+func (router *Router) deleteThumbnail(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, thumbnailsPath)
+	if !thumbnailIDRe.MatchString(id) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Bad thumbnail id"))
+		return
+	}
+
+	//без раскладки, определяющей путь по ID, пришлось бы просматривать всё хранилище
+	if !strings.Contains(id, "/") && !router.Layout.Resolvable() {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("The storage layout can't find thumbnails by id, use the thumbnail path"))
+		return
+	}
+
+	var names []string
+	var err error
+	if path.Ext(id) != "" {
+		var name string
+		if name, err = findThumbnail(r.Context(), router.Storage, router.Layout, id, ""); err == nil {
+			names = []string{name}
+		}
+	} else {
+		names, err = findVariants(r.Context(), router.Storage, router.Layout, id)
+	}
+	if err == storage.ErrNotExist || err == nil && len(names) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Thumbnail not found"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var deleted = []string{}
+	for _, name := range names {
+		if err := router.Storage.Delete(r.Context(), name); err != nil && err != storage.ErrNotExist {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		deleted = append(deleted, name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		ID      string   `json:"id"`
+		Deleted []string `json:"deleted"`
+	}{
+		ID:      id,
+		Deleted: deleted,
+	})
+}
+
+//findVariants ищет все файлы миниатюр с общим ID baseID: сам baseID и его варианты baseID_*.
+//baseID без директории переводится в путь через раскладку, которая должна это позволять.
+//Просматриваются только файлы, имя которых начинается с baseID
+func findVariants(ctx context.Context, store storage.Storage, layout *storage.Layout, baseID string) ([]string, error) {
+	var dir = path.Dir(baseID) + "/"
+	if !strings.Contains(baseID, "/") {
+		dir = ""
+		key := strings.TrimSuffix(layout.Key(storage.Fields{ID: baseID}), ".")
+		if path.Dir(key) != "." {
+			dir = path.Dir(key) + "/"
+		}
+	}
+
+	var base = path.Base(baseID)
+	files, err := store.List(ctx, dir+base, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if path.Dir(file.Name)+"/" != dir && (dir != "" || strings.Contains(file.Name, "/")) {
+			continue
+		}
+		name := path.Base(file.Name)
+		name = strings.TrimSuffix(name, path.Ext(name))
+		if name == base || strings.HasPrefix(name, base+"_") {
+			names = append(names, file.Name)
+		}
+	}
+	return names, nil
+}
+
+//thumbnailsPrefixRe допустимый префикс путей для списка миниатюр
+var thumbnailsPrefixRe = regexp.MustCompile(`^[A-Za-z0-9_./-]*$`)
+
+//thumbnailItem элемент списка миниатюр
+type thumbnailItem struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+//listThumbnails постраничный список миниатюр: GET /thumbnails?prefix=&cursor=&limit=.
+//cursor берётся из next_cursor предыдущей страницы
+func (router *Router) listThumbnails(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	if !thumbnailsPrefixRe.MatchString(prefix) || strings.Contains(prefix, "..") {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Bad value of parameter 'prefix': " + prefix))
+		return
+	}
+
+	after, err := base64.RawURLEncoding.DecodeString(query.Get("cursor"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Bad value of parameter 'cursor': " + query.Get("cursor")))
+		return
+	}
+
+	limit := config.GetInt(config.ThumbnailsPageSize)
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > config.GetInt(config.ThumbnailsMaxPageSize) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Bad value of parameter 'limit': " + v))
+			return
+		}
+	}
+
+	files, err := router.Storage.List(r.Context(), prefix, string(after), limit+1)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var page = struct {
+		Items      []thumbnailItem `json:"items"`
+		NextCursor string          `json:"next_cursor,omitempty"`
+	}{
+		Items: []thumbnailItem{},
+	}
+	if len(files) > limit {
+		files = files[:limit]
+		page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(files[limit-1].Name))
+	}
+	for _, file := range files {
+		name := path.Base(file.Name)
+		page.Items = append(page.Items, thumbnailItem{
+			ID:      strings.TrimSuffix(name, path.Ext(name)),
+			Path:    file.Name,
+			Size:    file.Size,
+			Created: file.ModTime,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
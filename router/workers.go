@@ -0,0 +1,21 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const workersPath = "/workers"
+
+//workers состояние пулов воркеров и решения автоскейлера: GET /workers
+func (router *Router) workers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("The path with this method is missing."))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(router.Resizer.Workers())
+}
@@ -1,7 +1,7 @@
 package server
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"net/http"
 	"os"
@@ -9,57 +9,110 @@ import (
 	"staply_img_resizer/config"
 	"staply_img_resizer/resizer"
 	router "staply_img_resizer/router"
+	"staply_img_resizer/storage"
 	"syscall"
 	"time"
 )
 
+//Коды завершения процесса, которые возвращает Serve
+const (
+	//ExitOK сервис остановлен по сигналу, все запросы и задачи завершены
+	ExitOK = 0
+	//ExitServeError сервер не смог запуститься или упал
+	ExitServeError = 1
+	//ExitShutdownTimeout за config.ShutdownGraceSec не все запросы или задачи успели завершиться
+	ExitShutdownTimeout = 2
+)
+
 type Server struct {
 	s          *http.Server
-	stopped    chan bool
 	osStopSigs chan os.Signal
-	workerStop func()
+	//workerShutdown останавливает пайплайн после того, как завершены все запросы
+	workerShutdown func(ctx context.Context) error
 }
 
 func NewServer() *Server {
 
-	reszr := resizer.NewImgResizer()
-	router := router.NewRouter(reszr)
+	store, err := storage.New()
+	if err != nil {
+		log.Fatalf("Can't create storage: %v", err)
+	}
+	//время чтения миниатюр нужно сборщику для вытеснения по lru
+	store = storage.NewTracked(store)
+	layout, err := storage.LayoutFromConfig()
+	if err != nil {
+		log.Fatalf("Bad storage layout config: %v", err)
+	}
+	if err = router.CheckPriority(); err != nil {
+		log.Fatalf("Bad priority config: %v", err)
+	}
+	if err = router.CheckBatch(); err != nil {
+		log.Fatalf("Bad batch config: %v", err)
+	}
+	if err = router.CheckResizeURL(layout); err != nil {
+		log.Fatalf("Bad resize url config: %v", err)
+	}
+	reszr := resizer.NewImgResizer(store)
+	router := router.NewRouter(reszr, store, layout)
 
 	var server = Server{
 		s: &http.Server{
 			Addr:           config.GetString(config.ServerRunAddress),
 			Handler:        &router,
-			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
+			ReadTimeout:    time.Second * config.GetDuration(config.ServerReadTimeoutSec),
+			WriteTimeout:   time.Second * config.GetDuration(config.ServerWriteTimeoutSec),
 			MaxHeaderBytes: 1 << 20,
 		},
 	}
 
-	server.workerStop = reszr.Stop
+	server.workerShutdown = reszr.Shutdown
 	server.osStopSigs = make(chan os.Signal, 1)
-	server.stopped = make(chan bool, 1)
 	signal.Notify(server.osStopSigs, os.Interrupt, syscall.SIGTERM)
 
 	return &server
 }
 
-func (s *Server) Serve() {
-
+//Serve запускает сервер и работает до сигнала остановки или ошибки сервера.
+//Возвращает код завершения процесса
+func (s *Server) Serve() int {
+	var serveErr = make(chan error, 1)
 	go func() {
 		log.Printf("starting server at %s", s.s.Addr)
-		if err := s.s.ListenAndServe(); err != nil {
-			log.Fatalf("Server error: %v", err.Error())
-		}
+		serveErr <- s.s.ListenAndServe()
 	}()
 
-	go func(stop func()) {
-		<-s.osStopSigs
-		fmt.Println()
-		fmt.Println("Stopping program...")
-		stop()
-		s.stopped <- true
-	}(s.workerStop)
+	var code = ExitOK
+	select {
+	case err := <-serveErr:
+		log.Printf("Server error: %v", err)
+		code = ExitServeError
+	case sig := <-s.osStopSigs:
+		log.Printf("Got %v, stopping program...", sig)
+	}
+
+	if !s.shutdown(time.Second*config.GetDuration(config.ShutdownGraceSec)) && code == ExitOK {
+		code = ExitShutdownTimeout
+	}
+	log.Printf("Done with code %d", code)
+	return code
+}
 
-	<-s.stopped
-	print("Done\n")
+//shutdown по порядку останавливает сервис за время grace: перестаёт принимать соединения,
+//дожидается завершения запросов, а затем останавливает этапы пайплайна.
+//Возвращает false, если не всё успело завершиться
+func (s *Server) shutdown(grace time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	var ok = true
+	if err := s.s.Shutdown(ctx); err != nil {
+		log.Printf("Can't drain http requests: %v", err)
+		s.s.Close()
+		ok = false
+	}
+	if err := s.workerShutdown(ctx); err != nil {
+		log.Printf("Can't drain pipeline: %v", err)
+		ok = false
+	}
+	return ok
 }
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"staply_img_resizer/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Готовые раскладки файлов для config.StorageLayout
+const (
+	//LayoutFlat все файлы в корне хранилища
+	LayoutFlat = "flat"
+	//LayoutSharded файлы по директориям из первых символов ID: ab/cd/abcd...webp
+	LayoutSharded = "sharded"
+	//LayoutDated файлы по директориям с датой сохранения: 2026/10/17/...webp
+	LayoutDated = "dated"
+)
+
+var layoutTemplates = map[string]string{
+	LayoutFlat:    "{id}.{ext}",
+	LayoutSharded: "{shard}/{id}.{ext}",
+	LayoutDated:   "{yyyy}/{mm}/{dd}/{id}.{ext}",
+}
+
+var layoutPlaceholderRe = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+//layoutLiteralRe допустимые символы шаблона вне подстановок
+var layoutLiteralRe = regexp.MustCompile(`^[A-Za-z0-9_./-]*$`)
+
+//layoutPlaceholderPatterns выражения для разбора значений подстановок из пути файла
+var layoutPlaceholderPatterns = map[string]string{
+	"shard":  `[^/]{2}/[^/]{2}`,
+	"ext":    `[^/.]*`,
+	"width":  `[0-9]+`,
+	"height": `[0-9]+`,
+	"yyyy":   `[0-9]{4}`,
+	"mm":     `[0-9]{2}`,
+	"dd":     `[0-9]{2}`,
+}
+
+//layoutTimePlaceholders подстановки с датой сохранения файла
+var layoutTimePlaceholders = map[string]bool{"yyyy": true, "mm": true, "dd": true}
+
+//layoutPlaceholders допустимые подстановки. true - значение определяется ID файла
+var layoutPlaceholders = map[string]bool{
+	"id":      true,
+	"shard":   true,
+	"ext":     true,
+	"base_id": false,
+	"preset":  false,
+	"width":   false,
+	"height":  false,
+	"tenant":  false,
+	"yyyy":    false,
+	"mm":      false,
+	"dd":      false,
+}
+
+//Fields значения подстановок шаблона пути
+type Fields struct {
+	ID     string
+	BaseID string
+	Preset string
+	Tenant string
+	Width  int
+	Height int
+	//Ext расширение без точки
+	Ext  string
+	Time time.Time
+}
+
+//Layout шаблон пути файла в хранилище, например "{tenant}/{shard}/{id}.{ext}".
+//Пустые значения подстановок заменяются на "_"
+type Layout struct {
+	template   string
+	resolvable bool
+	timed      bool
+	//pathRe разбирает путь файла, placeholders - подстановки в порядке групп pathRe
+	pathRe       *regexp.Regexp
+	placeholders []string
+}
+
+//NewLayout создаёт раскладку из имени готовой раскладки или шаблона.
+//Шаблон должен содержать {id} и заканчиваться на .{ext}
+func NewLayout(template string) (*Layout, error) {
+	if t, ok := layoutTemplates[template]; ok {
+		template = t
+	}
+
+	if !strings.Contains(template, "{id}") || !strings.HasSuffix(template, ".{ext}") {
+		return nil, fmt.Errorf("layout template '%s' must contain {id} and end with .{ext}", template)
+	}
+	literal := layoutPlaceholderRe.ReplaceAllString(template, "")
+	if !layoutLiteralRe.MatchString(literal) || strings.HasPrefix(template, "/") || strings.Contains(template, "..") {
+		return nil, fmt.Errorf("bad layout template '%s'", template)
+	}
+
+	var layout = Layout{
+		template:   template,
+		resolvable: true,
+	}
+	var pattern = "^"
+	var last int
+	for _, m := range layoutPlaceholderRe.FindAllStringSubmatchIndex(template, -1) {
+		name := template[m[2]:m[3]]
+		byID, ok := layoutPlaceholders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown placeholder {%s} in layout template '%s'", name, template)
+		}
+		layout.resolvable = layout.resolvable && byID
+		layout.timed = layout.timed || layoutTimePlaceholders[name]
+
+		p, ok := layoutPlaceholderPatterns[name]
+		if !ok {
+			//значение заканчивается на первом подходящем разделителе: в {tenant}_{id} владелец - до первого "_"
+			p = `[^/]+?`
+		}
+		pattern += regexp.QuoteMeta(template[last:m[0]]) + "(" + p + ")"
+		layout.placeholders = append(layout.placeholders, name)
+		last = m[1]
+	}
+	layout.pathRe = regexp.MustCompile(pattern + regexp.QuoteMeta(template[last:]) + "$")
+	return &layout, nil
+}
+
+//LayoutFromConfig создаёт раскладку из config.StorageLayout
+func LayoutFromConfig() (*Layout, error) {
+	return NewLayout(config.GetString(config.StorageLayout))
+}
+
+//Key путь файла в хранилище
+func (l *Layout) Key(f Fields) string {
+	return layoutPlaceholderRe.ReplaceAllStringFunc(l.template, func(p string) string {
+		var v string
+		switch p {
+		case "{id}":
+			v = f.ID
+		case "{shard}":
+			id := f.ID + "____"
+			v = id[0:2] + "/" + id[2:4]
+		case "{ext}":
+			v = f.Ext
+		case "{base_id}":
+			v = f.BaseID
+		case "{preset}":
+			v = f.Preset
+		case "{tenant}":
+			v = f.Tenant
+		case "{width}":
+			v = strconv.Itoa(f.Width)
+		case "{height}":
+			v = strconv.Itoa(f.Height)
+		case "{yyyy}":
+			v = f.Time.UTC().Format("2006")
+		case "{mm}":
+			v = f.Time.UTC().Format("01")
+		case "{dd}":
+			v = f.Time.UTC().Format("02")
+		}
+		if v == "" && p != "{ext}" {
+			return "_"
+		}
+		return v
+	})
+}
+
+//Resolvable возвращает true, если путь файла определяется только его ID и расширением
+func (l *Layout) Resolvable() bool {
+	return l.resolvable
+}
+
+//Uses возвращает true, если шаблон содержит подстановку {placeholder}
+func (l *Layout) Uses(placeholder string) bool {
+	for _, p := range l.placeholders {
+		if p == placeholder {
+			return true
+		}
+	}
+	return false
+}
+
+//Parse разбирает путь файла по шаблону. Время и значения "_" не восстанавливаются
+func (l *Layout) Parse(name string) (Fields, bool) {
+	m := l.pathRe.FindStringSubmatch(name)
+	if m == nil {
+		return Fields{}, false
+	}
+
+	var f Fields
+	for i, p := range l.placeholders {
+		v := m[i+1]
+		if v == "_" {
+			v = ""
+		}
+		switch p {
+		case "id":
+			f.ID = v
+		case "base_id":
+			f.BaseID = v
+		case "preset":
+			f.Preset = v
+		case "tenant":
+			f.Tenant = v
+		case "width":
+			f.Width, _ = strconv.Atoi(v)
+		case "height":
+			f.Height, _ = strconv.Atoi(v)
+		case "ext":
+			f.Ext = v
+		}
+	}
+	return f, true
+}
+
+//TimeDependent возвращает true, если путь файла зависит от даты сохранения
+func (l *Layout) TimeDependent() bool {
+	return l.timed
+}
@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//Local хранилище в директории на локальном диске.
+//Файлы пишутся во временный файл в той же директории и атомарно переименовываются,
+//поэтому читатели не видят недописанных файлов
+type Local struct {
+	dir string
+	//SyncDir синхронизировать директорию после переименования, чтобы оно пережило отключение питания
+	SyncDir bool
+}
+
+//tempPrefix префикс временных файлов, которые ещё пишутся
+const tempPrefix = ".tmp-"
+
+func NewLocal(dir string) *Local {
+	return &Local{
+		dir: dir,
+	}
+}
+
+func (l *Local) Put(ctx context.Context, name string, data []byte) error {
+	if err := l.check(ctx, name); err != nil {
+		return err
+	}
+
+	file := l.path(name)
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, tempPrefix+filepath.Base(file)+"-")
+	if err != nil {
+		return err
+	}
+	err = writeSync(tmp, data)
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if l.SyncDir {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+//SweepTemp удаляет временные файлы, оставшиеся после аварийной остановки.
+//Вызывается при старте, пока в хранилище никто не пишет
+func (l *Local) SweepTemp() (int, error) {
+	var count int
+	err := filepath.Walk(l.dir, func(file string, stat os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() && strings.HasPrefix(stat.Name(), tempPrefix) {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return count, nil
+	}
+	return count, err
+}
+
+func (l *Local) Get(ctx context.Context, name string) (Object, Info, error) {
+	if err := l.check(ctx, name); err != nil {
+		return nil, Info{}, err
+	}
+
+	file, err := os.Open(l.path(name))
+	if err != nil {
+		return nil, Info{}, notExist(err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, Info{}, err
+	}
+	if stat.IsDir() {
+		file.Close()
+		return nil, Info{}, ErrNotExist
+	}
+	return file, fileInfo(name, stat), nil
+}
+
+func (l *Local) Stat(ctx context.Context, name string) (Info, error) {
+	if err := l.check(ctx, name); err != nil {
+		return Info{}, err
+	}
+
+	stat, err := os.Stat(l.path(name))
+	if err != nil {
+		return Info{}, notExist(err)
+	}
+	if stat.IsDir() {
+		return Info{}, ErrNotExist
+	}
+	return fileInfo(name, stat), nil
+}
+
+func (l *Local) Delete(ctx context.Context, name string) error {
+	if err := l.check(ctx, name); err != nil {
+		return err
+	}
+
+	return notExist(os.Remove(l.path(name)))
+}
+
+func (l *Local) List(ctx context.Context, prefix string, after string, limit int) ([]Info, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var files []Info
+	err := l.list(ctx, "", prefix, after, limit, &files)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil && err != errListFull {
+		return nil, err
+	}
+	return files, nil
+}
+
+//errListFull останавливает обход, когда набрано limit файлов
+var errListFull = errors.New("list is full")
+
+//list обходит директорию dir в порядке имён файлов и добавляет в files файлы с префиксом prefix после after.
+//Ключ поддиректории - её имя со слешем, поэтому порядок обхода совпадает с порядком полных имён, поддиректории
+//целиком до after пропускаются, а обход останавливается, как только набрано limit файлов
+func (l *Local) list(ctx context.Context, dir string, prefix string, after string, limit int, files *[]Info) error {
+	stats, err := ioutil.ReadDir(l.path(dir))
+	if err != nil {
+		if dir != "" && os.IsNotExist(err) {
+			//директорию удалили во время обхода
+			return nil
+		}
+		return err
+	}
+
+	var keys = make([]string, len(stats))
+	for i, stat := range stats {
+		keys[i] = path.Join(dir, stat.Name())
+		if stat.IsDir() {
+			keys[i] += "/"
+		}
+	}
+	sort.Sort(byKey{keys, stats})
+
+	for i, stat := range stats {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key := keys[i]
+		if stat.IsDir() {
+			//в директории, которые не могут содержать файлы с префиксом или после after, не заходим
+			if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+				continue
+			}
+			if key < after && !strings.HasPrefix(after, key) {
+				continue
+			}
+			if err := l.list(ctx, strings.TrimSuffix(key, "/"), prefix, after, limit, files); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(key, prefix) && key > after && !strings.HasPrefix(stat.Name(), tempPrefix) {
+			*files = append(*files, fileInfo(key, stat))
+			if limit > 0 && len(*files) >= limit {
+				return errListFull
+			}
+		}
+	}
+	return nil
+}
+
+//byKey сортирует файлы директории по ключам обхода
+type byKey struct {
+	keys  []string
+	stats []os.FileInfo
+}
+
+func (b byKey) Len() int           { return len(b.keys) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byKey) Swap(i, j int) {
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+	b.stats[i], b.stats[j] = b.stats[j], b.stats[i]
+}
+
+func (l *Local) check(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return checkName(name)
+}
+
+func (l *Local) path(name string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(name))
+}
+
+//writeSync пишет данные в файл, сбрасывает их на диск и закрывает файл
+func writeSync(file *os.File, data []byte) error {
+	_, err := file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func fileInfo(name string, stat os.FileInfo) Info {
+	return Info{
+		Name:    name,
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+	}
+}
+
+//notExist заменяет ошибку отсутствия файла на ErrNotExist
+func notExist(err error) error {
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Memory хранилище в памяти процесса. Подходит для тестов и одноразовых запусков
+type Memory struct {
+	mu    sync.RWMutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		files: make(map[string]memoryFile),
+	}
+}
+
+func (m *Memory) Put(ctx context.Context, name string, data []byte) error {
+	if err := m.check(ctx, name); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = memoryFile{
+		data:    append([]byte(nil), data...),
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+func (m *Memory) Get(ctx context.Context, name string) (Object, Info, error) {
+	if err := m.check(ctx, name); err != nil {
+		return nil, Info{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	file, ok := m.files[name]
+	if !ok {
+		return nil, Info{}, ErrNotExist
+	}
+	return memoryObject{bytes.NewReader(file.data)}, file.info(name), nil
+}
+
+func (m *Memory) Stat(ctx context.Context, name string) (Info, error) {
+	if err := m.check(ctx, name); err != nil {
+		return Info{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	file, ok := m.files[name]
+	if !ok {
+		return Info{}, ErrNotExist
+	}
+	return file.info(name), nil
+}
+
+func (m *Memory) Delete(ctx context.Context, name string) error {
+	if err := m.check(ctx, name); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return ErrNotExist
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *Memory) List(ctx context.Context, prefix string, after string, limit int) ([]Info, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	var files []Info
+	for name, file := range m.files {
+		if strings.HasPrefix(name, prefix) && name > after {
+			files = append(files, file.info(name))
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	if limit > 0 && len(files) > limit {
+		files = files[:limit]
+	}
+	return files, nil
+}
+
+func (m *Memory) check(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return checkName(name)
+}
+
+func (f memoryFile) info(name string) Info {
+	return Info{
+		Name:    name,
+		Size:    int64(len(f.data)),
+		ModTime: f.modTime,
+	}
+}
+
+type memoryObject struct {
+	*bytes.Reader
+}
+
+func (memoryObject) Close() error {
+	return nil
+}
@@ -0,0 +1,523 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//S3Config параметры S3-совместимого хранилища
+type S3Config struct {
+	//Endpoint адрес сервиса, например https://s3.amazonaws.com или http://minio:9000
+	Endpoint string
+	Region   string
+	Bucket   string
+	//Prefix префикс ключей, под которым сохраняются миниатюры
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	//ACL canned ACL объектов, например public-read. Пустой - ACL бакета
+	ACL          string
+	CacheControl string
+	//PathStyle адресация bucket в пути, а не в имени хоста. Нужна для minio и большинства S3-совместимых сервисов
+	PathStyle bool
+	//PartSize размер части при multipart загрузке. Файлы больше PartSize загружаются по частям
+	PartSize int64
+	Client   *http.Client
+	//StreamClient клиент для чтения объектов потоком. Общий таймаут Client оборвал бы чтение большого объекта,
+	//поэтому по умолчанию это Client без таймаута, а чтение ограничивает контекст запроса
+	StreamClient *http.Client
+}
+
+//minPartSize минимальный размер части multipart загрузки в S3
+const minPartSize = 5 << 20
+
+//S3 хранилище в S3-совместимом бакете. Запросы подписываются AWS Signature Version 4
+type S3 struct {
+	cfg S3Config
+	now func() time.Time
+}
+
+func NewS3(cfg S3Config) *S3 {
+	if cfg.PartSize < minPartSize {
+		cfg.PartSize = minPartSize
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.StreamClient == nil {
+		stream := *cfg.Client
+		stream.Timeout = 0
+		cfg.StreamClient = &stream
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	return &S3{
+		cfg: cfg,
+		now: time.Now,
+	}
+}
+
+func (s *S3) Put(ctx context.Context, name string, data []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	if int64(len(data)) > s.cfg.PartSize {
+		return s.putMultipart(ctx, name, data)
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, s.key(name), nil, s.objectHeader(name), data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, name string) (Object, Info, error) {
+	if err := checkName(name); err != nil {
+		return nil, Info{}, err
+	}
+
+	resp, err := s.send(ctx, s.cfg.StreamClient, http.MethodGet, s.key(name), nil, nil, nil)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	info := responseInfo(name, resp)
+	if info.Size >= 0 {
+		return &s3Object{ctx: ctx, s: s, key: s.key(name), size: info.Size, body: resp.Body}, info, nil
+	}
+
+	//без размера объекта переход по нему невозможен, поэтому он читается целиком
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	info.Size = int64(len(data))
+	return memoryObject{bytes.NewReader(data)}, info, nil
+}
+
+//s3Object объект S3, который читается потоком из ответа. Seek только меняет позицию, а поток
+//заменяется лишь тогда, когда Read идёт не с его позиции: новый поток запрашивается через заголовок Range
+type s3Object struct {
+	ctx  context.Context
+	s    *S3
+	key  string
+	size int64
+	pos  int64
+	//body открытый поток объекта, nil - его нужно открыть
+	body io.ReadCloser
+	//bodyPos позиция, с которой читает body
+	bodyPos int64
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.pos >= o.size {
+		return 0, io.EOF
+	}
+	if o.body != nil && o.bodyPos != o.pos {
+		o.body.Close()
+		o.body = nil
+	}
+	if o.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.pos)}}
+		resp, err := o.s.send(o.ctx, o.s.cfg.StreamClient, http.MethodGet, o.key, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return 0, fmt.Errorf("s3: range request for %s answered %s", o.key, resp.Status)
+		}
+		o.body = resp.Body
+		o.bodyPos = o.pos
+	}
+	n, err := o.body.Read(p)
+	o.pos += int64(n)
+	o.bodyPos = o.pos
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = o.pos + offset
+	case io.SeekEnd:
+		pos = o.size + offset
+	default:
+		return 0, fmt.Errorf("s3: bad whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("s3: negative position %d", pos)
+	}
+	o.pos = pos
+	return pos, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+func (s *S3) Stat(ctx context.Context, name string) (Info, error) {
+	if err := checkName(name); err != nil {
+		return Info{}, err
+	}
+
+	resp, err := s.do(ctx, http.MethodHead, s.key(name), nil, nil, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	return responseInfo(name, resp), nil
+}
+
+//Delete удаляет объект. S3 не сообщает об удалении несуществующего объекта, поэтому он проверяется заранее
+func (s *S3) Delete(ctx context.Context, name string) error {
+	if _, err := s.Stat(ctx, name); err != nil {
+		return err
+	}
+
+	resp, err := s.do(ctx, http.MethodDelete, s.key(name), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3) List(ctx context.Context, prefix string, after string, limit int) ([]Info, error) {
+	var files []Info
+	var token string
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.key(prefix)},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		} else if after != "" {
+			query.Set("start-after", s.key(after))
+		}
+		if limit > 0 {
+			query.Set("max-keys", strconv.Itoa(limit-len(files)))
+		}
+
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var list listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list: bad response; error %v", err)
+		}
+
+		for _, obj := range list.Contents {
+			files = append(files, Info{
+				Name:    strings.TrimPrefix(obj.Key, s.key("")),
+				Size:    obj.Size,
+				ModTime: obj.LastModified,
+			})
+		}
+
+		if !list.IsTruncated || list.NextContinuationToken == "" || (limit > 0 && len(files) >= limit) {
+			break
+		}
+		token = list.NextContinuationToken
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files, nil
+}
+
+//putMultipart загружает файл частями по PartSize. При ошибке загрузка отменяется
+func (s *S3) putMultipart(ctx context.Context, name string, data []byte) error {
+	key := s.key(name)
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, s.objectHeader(name), nil)
+	if err != nil {
+		return err
+	}
+	var upload struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&upload)
+	resp.Body.Close()
+	if err != nil || upload.UploadID == "" {
+		return fmt.Errorf("s3 multipart upload of %s: bad initiate response; error %v", name, err)
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for start := int64(0); start < int64(len(data)); start += s.cfg.PartSize {
+		end := start + s.cfg.PartSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		number := len(complete.Parts) + 1
+		resp, err := s.do(ctx, http.MethodPut, key, url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {upload.UploadID},
+		}, nil, data[start:end])
+		if err != nil {
+			s.abortMultipart(key, upload.UploadID)
+			return err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, part{number, resp.Header.Get("ETag")})
+	}
+
+	body, _ := xml.Marshal(complete)
+	resp, err = s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {upload.UploadID}}, nil, body)
+	if err != nil {
+		s.abortMultipart(key, upload.UploadID)
+		return err
+	}
+	defer resp.Body.Close()
+
+	//S3 может вернуть ошибку завершения загрузки с кодом 200 в теле ответа
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err == nil && result.XMLName.Local == "Error" {
+		s.abortMultipart(key, upload.UploadID)
+		return fmt.Errorf("s3 multipart upload of %s: %s %s", name, result.Code, result.Message)
+	}
+	return nil
+}
+
+func (s *S3) abortMultipart(key string, uploadID string) {
+	resp, err := s.do(context.Background(), http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+//objectHeader метаданные сохраняемого объекта
+func (s *S3) objectHeader(name string) http.Header {
+	var header = make(http.Header)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header.Set("Content-Type", contentType)
+	if s.cfg.CacheControl != "" {
+		header.Set("Cache-Control", s.cfg.CacheControl)
+	}
+	if s.cfg.ACL != "" {
+		header.Set("X-Amz-Acl", s.cfg.ACL)
+	}
+	return header
+}
+
+func (s *S3) key(name string) string {
+	if s.cfg.Prefix == "" {
+		return name
+	}
+	return s.cfg.Prefix + "/" + name
+}
+
+//do выполняет подписанный запрос к объекту key или, если key пустой, к бакету.
+//Ответ 404 возвращается как ErrNotExist, остальные коды кроме 2xx - как ошибка
+func (s *S3) do(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	return s.send(ctx, s.cfg.Client, method, key, query, header, body)
+}
+
+//send выполняет запрос do через клиент client
+func (s *S3) send(ctx context.Context, client *http.Client, method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(s.cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3: bad endpoint %s; error %v", s.cfg.Endpoint, err)
+	}
+	if s.cfg.PathStyle {
+		u.Path = "/" + s.cfg.Bucket + "/" + key
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, body)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var s3Err struct {
+		Code    string
+		Message string
+	}
+	xml.NewDecoder(resp.Body).Decode(&s3Err)
+	//у ответа на HEAD нет тела, поэтому пустой код тоже считается отсутствием объекта
+	if resp.StatusCode == http.StatusNotFound && key != "" && len(query) == 0 &&
+		(s3Err.Code == "" || s3Err.Code == "NoSuchKey") {
+		return nil, ErrNotExist
+	}
+	return nil, fmt.Errorf("s3 %s %s: %d %s %s", method, key, resp.StatusCode, s3Err.Code, s3Err.Message)
+}
+
+//sign подписывает запрос AWS Signature Version 4. Без ключа запрос не подписывается
+func (s *S3) sign(req *http.Request, body []byte) {
+	if s.cfg.AccessKey == "" {
+		return
+	}
+
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+
+	var headers = map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := now.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+//canonicalQuery параметры запроса, отсортированные и закодированные по правилам подписи
+func canonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+//uriEncode кодирует всё, кроме незарезервированных символов, и "/", если encodeSlash false
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func responseInfo(name string, resp *http.Response) Info {
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Info{
+		Name:    name,
+		Size:    resp.ContentLength,
+		ModTime: modTime,
+	}
+}
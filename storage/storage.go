@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"staply_img_resizer/config"
+	"strings"
+	"time"
+)
+
+//ErrNotExist возвращается, если файла нет в хранилище
+var ErrNotExist = errors.New("file does not exist")
+
+//Storage хранилище миниатюр. Имена файлов - относительные пути через "/"
+type Storage interface {
+	//Put сохраняет файл, перезаписывая существующий
+	Put(ctx context.Context, name string, data []byte) error
+	//Get открывает файл на чтение. Object нужно закрыть
+	Get(ctx context.Context, name string) (Object, Info, error)
+	Stat(ctx context.Context, name string) (Info, error)
+	Delete(ctx context.Context, name string) error
+	//List возвращает отсортированные по имени файлы с префиксом prefix, имена которых больше after.
+	//limit ограничивает количество файлов, 0 - без ограничений
+	List(ctx context.Context, prefix string, after string, limit int) ([]Info, error)
+}
+
+//Object содержимое файла из хранилища
+type Object interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+//Info описание файла в хранилище
+type Info struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+//Backend типы хранилищ для config.StorageBackend
+const (
+	BackendLocal  = "local"
+	BackendMemory = "memory"
+	BackendS3     = "s3"
+)
+
+//New создаёт хранилище, указанное в config.StorageBackend.
+//Временные файлы локального хранилища, оставшиеся после аварийной остановки, удаляются
+func New() (Storage, error) {
+	return newStorage(true)
+}
+
+//NewShared создаёт хранилище, которым одновременно пользуется запущенный сервис.
+//Временные файлы не удаляются, чтобы не прервать его запись
+func NewShared() (Storage, error) {
+	return newStorage(false)
+}
+
+func newStorage(sweepTemp bool) (Storage, error) {
+	switch backend := config.GetString(config.StorageBackend); backend {
+	case BackendLocal:
+		local := NewLocal(config.GetString(config.FileSaveDir))
+		local.SyncDir = config.GetBool(config.LocalSyncDir)
+		if !sweepTemp {
+			return local, nil
+		}
+		count, err := local.SweepTemp()
+		if err != nil {
+			return nil, fmt.Errorf("can't sweep temp files; error %v", err)
+		}
+		log.Printf("Removed orphaned temp files: %v", count)
+		return local, nil
+	case BackendMemory:
+		return NewMemory(), nil
+	case BackendS3:
+		if config.GetString(config.S3Bucket) == "" {
+			return nil, fmt.Errorf("s3 bucket is not configured")
+		}
+		return NewS3(S3Config{
+			Endpoint:     config.GetString(config.S3Endpoint),
+			Region:       config.GetString(config.S3Region),
+			Bucket:       config.GetString(config.S3Bucket),
+			Prefix:       config.GetString(config.S3Prefix),
+			AccessKey:    config.GetString(config.S3AccessKey),
+			SecretKey:    config.GetString(config.S3SecretKey),
+			SessionToken: config.GetString(config.S3SessionToken),
+			ACL:          config.GetString(config.S3ACL),
+			CacheControl: config.GetString(config.S3CacheControl),
+			PathStyle:    config.GetBool(config.S3PathStyle),
+			PartSize:     config.GetInt64(config.S3PartSizeByte),
+			Client:       config.HTTPClient,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend '%s'", backend)
+	}
+}
+
+//checkName не даёт выйти за пределы хранилища через имя файла
+func checkName(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") || path.Clean(name) != name || strings.HasPrefix(name, "../") || name == ".." {
+		return fmt.Errorf("bad file name '%s'", name)
+	}
+	return nil
+}
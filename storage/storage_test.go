@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"staply_img_resizer/config"
+	"testing"
+	"time"
+)
+
+func TestStorage(t *testing.T) {
+	os.MkdirAll("test_out", os.ModePerm)
+	defer os.RemoveAll("test_out")
+
+	fake := newFakeS3("thumbnails")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	for name, store := range map[string]Storage{
+		"local":  NewLocal("test_out"),
+		"memory": NewMemory(),
+		"s3":     NewS3(S3Config{Endpoint: server.URL, Region: "us-east-1", Bucket: "thumbnails", AccessKey: "key", SecretKey: "secret", PathStyle: true}),
+	} {
+		testStorage(t, name, store)
+	}
+}
+
+func testStorage(t *testing.T, name string, store Storage) {
+	{
+		ctx := context.Background()
+		for _, file := range []string{"b.png", "a.jpeg", "a.webp", "dir/a.png", "c.png", "dir-b.png", "dir/z/a.png"} {
+			if err := store.Put(ctx, file, []byte(file)); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+
+		obj, info, err := store.Get(ctx, "a.webp")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		data, _ := ioutil.ReadAll(obj)
+		obj.Close()
+		if string(data) != "a.webp" || info.Size != 6 || info.Name != "a.webp" {
+			t.Errorf("%s: Bad file. Expected 'a.webp', got '%s' with info '%+v'", name, data, info)
+		}
+
+		if _, err := store.Stat(ctx, "missing.png"); err != ErrNotExist {
+			t.Errorf("%s: Bad stat error. Expected '%v', got '%v'", name, ErrNotExist, err)
+		}
+		if _, _, err := store.Get(ctx, "missing.png"); err != ErrNotExist {
+			t.Errorf("%s: Bad get error. Expected '%v', got '%v'", name, ErrNotExist, err)
+		}
+		if err := store.Put(ctx, "../escape.png", nil); err == nil {
+			t.Errorf("%s: Expected error for file outside of storage", name)
+		}
+
+		testCases := []struct {
+			Prefix   string
+			After    string
+			Limit    int
+			Expected []string
+		}{
+			{"", "", 0, []string{"a.jpeg", "a.webp", "b.png", "c.png", "dir-b.png", "dir/a.png", "dir/z/a.png"}},
+			{"a.", "", 0, []string{"a.jpeg", "a.webp"}},
+			{"", "a.webp", 2, []string{"b.png", "c.png"}},
+			{"", "c.png", 2, []string{"dir-b.png", "dir/a.png"}},
+			{"", "dir-b.png", 1, []string{"dir/a.png"}},
+			{"", "dir/a.png", 0, []string{"dir/z/a.png"}},
+			{"dir/", "", 0, []string{"dir/a.png", "dir/z/a.png"}},
+			{"x", "", 0, nil},
+		}
+		for _, tCase := range testCases {
+			files, err := store.List(ctx, tCase.Prefix, tCase.After, tCase.Limit)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			var names []string
+			for _, f := range files {
+				names = append(names, f.Name)
+			}
+			if !reflect.DeepEqual(names, tCase.Expected) {
+				t.Errorf("%s: Bad list for %+v. Expected '%v', got '%v'", name, tCase, tCase.Expected, names)
+			}
+		}
+
+		if err := store.Delete(ctx, "b.png"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if err := store.Delete(ctx, "b.png"); err != ErrNotExist {
+			t.Errorf("%s: Bad delete error. Expected '%v', got '%v'", name, ErrNotExist, err)
+		}
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		if err := store.Put(cancelled, "d.png", nil); err != context.Canceled {
+			t.Errorf("%s: Bad error for cancelled context. Expected '%v', got '%v'", name, context.Canceled, err)
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	fields := Fields{
+		ID:     "abcdef_avatar",
+		BaseID: "abcdef",
+		Preset: "avatar",
+		Width:  64,
+		Height: 48,
+		Ext:    "webp",
+		Time:   time.Date(2026, 10, 17, 23, 0, 0, 0, time.UTC),
+	}
+
+	testCases := []struct {
+		Template           string
+		ExpectedKey        string
+		ExpectedResolvable bool
+		ExpectedTimed      bool
+		ExpectedErr        bool
+	}{
+		{LayoutFlat, "abcdef_avatar.webp", true, false, false},
+		{LayoutSharded, "ab/cd/abcdef_avatar.webp", true, false, false},
+		{LayoutDated, "2026/10/17/abcdef_avatar.webp", false, true, false},
+		{"{tenant}/{preset}/{width}x{height}/{base_id}/{id}.{ext}", "_/avatar/64x48/abcdef/abcdef_avatar.webp", false, false, false},
+		{"{tenant}/{yyyy}/{id}.{ext}", "_/2026/abcdef_avatar.webp", false, true, false},
+		{"{id}", "", false, false, true},
+		{"{size}/{id}.{ext}", "", false, false, true},
+		{"../{id}.{ext}", "", false, false, true},
+		{"/{id}.{ext}", "", false, false, true},
+	}
+
+	for _, tCase := range testCases {
+		layout, err := NewLayout(tCase.Template)
+		if (err != nil) != tCase.ExpectedErr {
+			t.Errorf("Bad error for '%v'. Expected error '%v', got '%v'", tCase.Template, tCase.ExpectedErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if key := layout.Key(fields); key != tCase.ExpectedKey {
+			t.Errorf("Bad key for '%v'. Expected '%v', got '%v'", tCase.Template, tCase.ExpectedKey, key)
+		}
+		if layout.Resolvable() != tCase.ExpectedResolvable {
+			t.Errorf("Bad resolvable for '%v'. Expected '%v', got '%v'", tCase.Template, tCase.ExpectedResolvable, layout.Resolvable())
+		}
+		if layout.TimeDependent() != tCase.ExpectedTimed {
+			t.Errorf("Bad time dependence for '%v'. Expected '%v', got '%v'", tCase.Template, tCase.ExpectedTimed, layout.TimeDependent())
+		}
+	}
+}
+
+func TestLayoutParse(t *testing.T) {
+	testCases := []struct {
+		Template       string
+		Name           string
+		ExpectedFields Fields
+		ExpectedOk     bool
+	}{
+		{LayoutFlat, "abcdef_original.jpeg", Fields{ID: "abcdef_original", Ext: "jpeg"}, true},
+		{LayoutSharded, "ab/cd/abcdef.webp", Fields{ID: "abcdef", Ext: "webp"}, true},
+		{LayoutSharded, "abcdef.webp", Fields{}, false},
+		{"{tenant}/{shard}/{id}.{ext}", "acme/ab/cd/abcdef_card.png", Fields{ID: "abcdef_card", Tenant: "acme", Ext: "png"}, true},
+		{"{tenant}/{id}.{ext}", "_/abcdef.png", Fields{ID: "abcdef", Ext: "png"}, true},
+		{"{tenant}_{id}.{ext}", "acme_abcdef_64x64_crop.png", Fields{ID: "abcdef_64x64_crop", Tenant: "acme", Ext: "png"}, true},
+		{"{tenant}/{width}x{height}/{id}.{ext}", "acme/64x48/abcdef.png", Fields{ID: "abcdef", Tenant: "acme", Width: 64, Height: 48, Ext: "png"}, true},
+		{LayoutDated, "2026/10/17/abcdef.png", Fields{ID: "abcdef", Ext: "png"}, true},
+		{LayoutDated, "2026/oct/17/abcdef.png", Fields{}, false},
+	}
+
+	for _, tCase := range testCases {
+		layout, err := NewLayout(tCase.Template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields, ok := layout.Parse(tCase.Name)
+		if ok != tCase.ExpectedOk || fields != tCase.ExpectedFields {
+			t.Errorf("Bad fields of '%v' for '%v'. Expected '%+v' '%v', got '%+v' '%v'",
+				tCase.Name, tCase.Template, tCase.ExpectedFields, tCase.ExpectedOk, fields, ok)
+		}
+	}
+}
+
+func TestLocalTempFiles(t *testing.T) {
+	os.MkdirAll("test_out/dir", os.ModePerm)
+	defer os.RemoveAll("test_out")
+
+	store := NewLocal("test_out")
+	store.SyncDir = true
+	ctx := context.Background()
+	if err := store.Put(ctx, "dir/a.png", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, "dir/a.png", []byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile("test_out/dir/a.png")
+	if string(data) != "newer" {
+		t.Errorf("Bad file content. Expected 'newer', got '%s'", data)
+	}
+
+	//файл, оставшийся после остановки посреди записи
+	if err := ioutil.WriteFile("test_out/dir/"+tempPrefix+"b.png-123", []byte("half"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := store.List(ctx, "", "", 0)
+	if len(files) != 1 || files[0].Name != "dir/a.png" {
+		t.Errorf("Temp files must not be listed, got '%+v'", files)
+	}
+
+	//хранилище, общее с запущенным сервисом, не удаляет его временные файлы
+	config.Set(config.FileSaveDir, "test_out")
+	defer config.Set(config.FileSaveDir, "./thumbnails")
+	if _, err := NewShared(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("test_out/dir/" + tempPrefix + "b.png-123"); err != nil {
+		t.Errorf("Shared storage must keep temp files, got '%v'", err)
+	}
+
+	count, err := store.SweepTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Bad count of removed temp files. Expected '1', got '%v'", count)
+	}
+	entries, _ := ioutil.ReadDir("test_out/dir")
+	if len(entries) != 1 || entries[0].Name() != "a.png" || entries[0].Mode().Perm() != 0644 {
+		t.Errorf("Bad files after sweep, got '%v'", entries)
+	}
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//Tracked хранилище, которое запоминает время последнего чтения файлов.
+//Время чтения хранится в памяти и теряется при перезапуске
+type Tracked struct {
+	Storage
+	mu     sync.Mutex
+	access map[string]time.Time
+}
+
+func NewTracked(s Storage) *Tracked {
+	return &Tracked{
+		Storage: s,
+		access:  make(map[string]time.Time),
+	}
+}
+
+func (t *Tracked) Get(ctx context.Context, name string) (Object, Info, error) {
+	obj, info, err := t.Storage.Get(ctx, name)
+	if err == nil {
+		t.mu.Lock()
+		t.access[name] = time.Now()
+		t.mu.Unlock()
+	}
+	return obj, info, err
+}
+
+func (t *Tracked) Delete(ctx context.Context, name string) error {
+	err := t.Storage.Delete(ctx, name)
+	if err == nil || err == ErrNotExist {
+		t.mu.Lock()
+		delete(t.access, name)
+		t.mu.Unlock()
+	}
+	return err
+}
+
+//LastAccess время последнего чтения файла с момента запуска
+func (t *Tracked) LastAccess(name string) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	at, ok := t.access[name]
+	return at, ok
+}